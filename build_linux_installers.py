@@ -15,7 +15,9 @@ tools = [
 ]
 deps = [
     "github.com/sirupsen/logrus",
-    "gopkg.in/natefinch/lumberjack.v2"
+    "gopkg.in/natefinch/lumberjack.v2",
+    "github.com/pion/dtls/v3",
+    "golang.org/x/net/dns/dnsmessage"
 ]
 
 # get and save the current directory
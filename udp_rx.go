@@ -34,9 +34,6 @@ import (
 // Version is a constant that is this verion of the code, according to OTIS standards
 const Version = "A1231825AAB"
 
-// RemoteTLSPort is the port of the remote TLS server (also the port of the local TLS server)
-const RemoteTLSPort = ":55554"
-
 // tls config
 var clientConf *tls.Config
 var serverConf *tls.Config
@@ -74,6 +71,10 @@ func main() {
 	keyPathFlag := flag.String("keypath", defaultKeyPath, "Override the default key path/name which is ./keys/server.key")
 	certPathFlag := flag.String("certpath", defaultCertPath, "Override the default certificate path/name which is ./server.crt")
 	caCertPathFlag := flag.String("cacert", defaultCACertPath, "Set the Certificate Authority Certificate to add to the trust")
+	// port flags, 0 keeps the config file value or the default
+	tlsPortFlag := flag.Int("tlsport", 0, "Override the TLS listen port which is 55554")
+	udpPortFlag := flag.Int("udpport", 0, "Override the UDP ingress port which is 55555")
+	remotePortFlag := flag.Int("remoteport", 0, "Override the default TLS port of peers which is 55554")
 	flag.Parse()
 	// init the logger
 	if *lumberjackFlag {
@@ -96,10 +97,24 @@ func main() {
 	conf, err := udprxlib.ParseConfig(*confFileFlag)
 	if err == nil {
 		setConfigValues(&conf, listenAddrFlag, keyPathFlag, certPathFlag, caCertPathFlag)
+		err = udprxlib.ApplyConfig(conf)
+		if err != nil {
+			log.Fatal("Invalid config file. Error: ", err.Error())
+		}
 	} else {
 		log.Warn("Error parsing the config file. Error: ", err.Error())
 		setConfigValues(nil, listenAddrFlag, keyPathFlag, certPathFlag, caCertPathFlag)
 	}
+	// command line ports take precedence over the config file
+	if *tlsPortFlag != 0 {
+		udprxlib.TLSListenPort = *tlsPortFlag
+	}
+	if *udpPortFlag != 0 {
+		udprxlib.UDPListenPort = *udpPortFlag
+	}
+	if *remotePortFlag != 0 {
+		udprxlib.RemoteTLSPort = fmt.Sprintf(":%d", *remotePortFlag)
+	}
 
 	configLogger(logFlag)
 	log.Warning("Starting udp_rx version: ", Version)
@@ -141,12 +156,55 @@ func main() {
 	clientConf = &tls.Config{
 		RootCAs:      rootCAs,
 		Certificates: []tls.Certificate{cer},
+		// reconnects to a peer resume the session instead of a full handshake
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
 	}
 	serverConf = udprxlib.GetServerConfig(rootCAs, &cer)
 
+	// periodically log the packet and drop counters
+	go udprxlib.LogCounters(5 * time.Minute)
+	// keep the always up peers connected
+	go udprxlib.MaintainPeers(clientConf)
 	// start listening on the UDP port in go routine
 	udpListenerDone := make(chan error, 1)
 	go udprxlib.UDPListener(&listenAddr, clientConf, udpListenerDone)
+	// start a listener for each static tunnel
+	staticTunnelDone := make(chan error, len(conf.StaticTunnels))
+	for _, tunnel := range conf.StaticTunnels {
+		go udprxlib.StaticTunnelListener(&listenAddr, tunnel, clientConf, staticTunnelDone)
+	}
+	// join each multicast group port to capture locally generated multicast
+	for _, group := range conf.MulticastGroups {
+		multicastDone := make(chan error, len(group.Ports))
+		for _, port := range group.Ports {
+			go udprxlib.MulticastListener(group, port, clientConf, multicastDone)
+		}
+	}
+	// capture broadcasts on each relayed port
+	for _, relay := range conf.BroadcastRelays {
+		broadcastDone := make(chan error, len(relay.Ports))
+		for _, port := range relay.Ports {
+			go udprxlib.BroadcastListener(relay, port, clientConf, broadcastDone)
+		}
+	}
+	// start the stream ingress listeners
+	streamDone := make(chan error, 2)
+	if conf.StreamSocket != "" {
+		go udprxlib.StreamListener("unix", conf.StreamSocket, clientConf, streamDone)
+	}
+	if conf.StreamTCPPort != 0 {
+		go udprxlib.StreamListener("tcp", fmt.Sprintf("127.0.0.1:%d", conf.StreamTCPPort), clientConf, streamDone)
+	}
+	// start the transparent interception listener if it's configured
+	if conf.TransparentPort != 0 {
+		transparentDone := make(chan error, 1)
+		go udprxlib.TransparentListener(&listenAddr, conf.TransparentPort, clientConf, transparentDone)
+	}
+	// accept DTLS links from peers if it's turned on
+	if conf.DTLS {
+		dtlsListenerDone := make(chan error, 1)
+		go udprxlib.DTLSListener(&listenAddr, serverConf, dtlsListenerDone)
+	}
 	// start listening on TCP on main thread (blocking main from returning)
 	tcpListenerDone := make(chan error, 1)
 	udprxlib.TCPListener(&listenAddr, serverConf, tcpListenerDone)
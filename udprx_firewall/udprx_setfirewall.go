@@ -15,8 +15,19 @@ import (
 func main() {
 	portsList := flag.String("portlist", "/etc/udp_rx/portslist", "Override the default ports list")
 	unsetFlag := flag.Bool("unset", false, "if set to true, will unset the iptables rules")
+	tproxyPortFlag := flag.Int("tproxyport", 0, "udp_rx's transparentPort. If set, also sets the TPROXY rules for transparent interception")
+	tproxyListFlag := flag.String("tproxylist", "/etc/udp_rx/tproxylist", "the list of destination ports to intercept with TPROXY")
+	replySessionsFlag := flag.Bool("replysessions", false, "with -tproxyport, also send replies to packets udp_rx delivered to its transparent listener")
 	flag.Parse()
 
+	// transparent interception rules
+	if *tproxyPortFlag != 0 {
+		setTProxy(*tproxyListFlag, *tproxyPortFlag, *unsetFlag)
+		if *replySessionsFlag {
+			setReplySessions(*tproxyPortFlag, *unsetFlag)
+		}
+	}
+
 	// get a list of this machines interfaces
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -82,3 +93,127 @@ func runIPTables(setArg, portNumber, netInterface string) error {
 	cmd := exec.Command("iptables", setArg, "INPUT", "-i", netInterface, "-p", "udp", "--dport", portNumber, "-j", "REJECT")
 	return cmd.Run()
 }
+
+// the firewall mark and routing table used to send intercepted packets to udp_rx
+const tproxyMark = "0x1"
+const tproxyTable = "100"
+
+// setTProxy sets (or unsets) the rules that redirect udp traffic for each port in the
+// ports list to udp_rx's transparent listener. Traffic to local addresses is never
+// intercepted, so udp_rx can still deliver packets to local applications
+func setTProxy(portsList string, tproxyPort int, unset bool) {
+	file, err := os.Open(portsList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	onPort := strconv.Itoa(tproxyPort)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		portNumber := scanner.Text()
+		_, err := strconv.Atoi(portNumber)
+		if err != nil {
+			log.Printf("bypassing tproxy line, invalid format: %s\n", portNumber)
+			continue
+		}
+		// packets from other hosts, and locally generated packets looped back by the
+		// policy route, are handed to udp_rx in PREROUTING
+		prerouting := []string{"PREROUTING", "-p", "udp", "--dport", portNumber,
+			"-m", "addrtype", "!", "--dst-type", "LOCAL",
+			"-j", "TPROXY", "--on-port", onPort, "--tproxy-mark", tproxyMark + "/" + tproxyMark}
+		// locally generated packets are marked so the policy route loops them back
+		output := []string{"OUTPUT", "-p", "udp", "--dport", portNumber,
+			"-m", "addrtype", "!", "--dst-type", "LOCAL",
+			"-j", "MARK", "--set-mark", tproxyMark}
+		for _, rule := range [][]string{prerouting, output} {
+			if !unset {
+				// if there was NO error, the rule already exists
+				if runMangle("-C", rule) == nil {
+					continue
+				}
+				err = runMangle("-I", rule)
+				if err != nil {
+					log.Printf("Error creating tproxy rule. Error: %s", err.Error())
+				}
+			} else {
+				for {
+					if runMangle("-D", rule) != nil {
+						break
+					}
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	// route marked packets to the local machine. Remove any existing copies first so
+	// the rule and route are never duplicated
+	for {
+		if exec.Command("ip", "rule", "del", "fwmark", tproxyMark, "lookup", tproxyTable).Run() != nil {
+			break
+		}
+	}
+	exec.Command("ip", "route", "del", "local", "0.0.0.0/0", "dev", "lo", "table", tproxyTable).Run()
+	if !unset {
+		err = exec.Command("ip", "rule", "add", "fwmark", tproxyMark, "lookup", tproxyTable).Run()
+		if err != nil {
+			log.Printf("Error creating tproxy ip rule. Error: %s", err.Error())
+		}
+		err = exec.Command("ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", tproxyTable).Run()
+		if err != nil {
+			log.Printf("Error creating tproxy route. Error: %s", err.Error())
+		}
+		log.Print("udprx_firewall - set tproxy rules")
+	} else {
+		log.Print("udprx_firewall - unset tproxy rules")
+	}
+}
+
+// sessionMark is the socket mark udp_rx puts on the packets it delivers when its
+// replySessions setting is on
+const sessionMark = "0x2"
+
+// setReplySessions sets (or unsets) the rules that send replies to packets udp_rx
+// delivered to the transparent listener. Delivered packets carry sessionMark, which is
+// saved on their connection. Packets in the reply direction of those connections are
+// marked for the tproxy policy route, and handed to udp_rx in PREROUTING
+func setReplySessions(tproxyPort int, unset bool) {
+	onPort := strconv.Itoa(tproxyPort)
+	saveMark := []string{"OUTPUT", "-p", "udp", "-m", "mark", "--mark", sessionMark + "/" + sessionMark,
+		"-j", "CONNMARK", "--set-mark", sessionMark + "/" + sessionMark}
+	markReply := []string{"OUTPUT", "-p", "udp", "-m", "connmark", "--mark", sessionMark + "/" + sessionMark,
+		"-m", "conntrack", "--ctdir", "REPLY", "-j", "MARK", "--set-mark", tproxyMark}
+	prerouting := []string{"PREROUTING", "-p", "udp", "-m", "connmark", "--mark", sessionMark + "/" + sessionMark,
+		"-m", "conntrack", "--ctdir", "REPLY",
+		"-j", "TPROXY", "--on-port", onPort, "--tproxy-mark", tproxyMark + "/" + tproxyMark}
+	for _, rule := range [][]string{saveMark, markReply, prerouting} {
+		if !unset {
+			// if there was NO error, the rule already exists
+			if runMangle("-C", rule) == nil {
+				continue
+			}
+			err := runMangle("-I", rule)
+			if err != nil {
+				log.Printf("Error creating reply session rule. Error: %s", err.Error())
+			}
+		} else {
+			for {
+				if runMangle("-D", rule) != nil {
+					break
+				}
+			}
+		}
+	}
+	if !unset {
+		log.Print("udprx_firewall - set reply session rules")
+	} else {
+		log.Print("udprx_firewall - unset reply session rules")
+	}
+}
+
+func runMangle(setArg string, rule []string) error {
+	args := append([]string{"-t", "mangle", setArg}, rule...)
+	cmd := exec.Command("iptables", args...)
+	return cmd.Run()
+}
@@ -35,10 +35,15 @@ var listenAddr, keyPath, certPath, caCertPath string
 var clientConf *tls.Config
 var serverConf *tls.Config
 
+// the parsed config file
+var udprxConf udprxlib.ConfFile
+
 var elog debug.Log
 
 type myservice struct{}
 
+// startNetListeners starts the same listeners as udp_rx does outside of the service.
+// Only the UDP and TCP listeners stopping stops the service
 func startNetListeners() (chan error, chan error) {
 	// setup error channels
 	udpListenerChan := make(chan error, 1)
@@ -46,6 +51,43 @@ func startNetListeners() (chan error, chan error) {
 	// start the threads
 	go udprxlib.UDPListener(&listenAddr, clientConf, udpListenerChan)
 	go udprxlib.TCPListener(&listenAddr, serverConf, tcpListenerChan)
+	// start a listener for each static tunnel
+	staticTunnelChan := make(chan error, len(udprxConf.StaticTunnels))
+	for _, tunnel := range udprxConf.StaticTunnels {
+		go udprxlib.StaticTunnelListener(&listenAddr, tunnel, clientConf, staticTunnelChan)
+	}
+	// join each multicast group port to capture locally generated multicast
+	for _, group := range udprxConf.MulticastGroups {
+		multicastChan := make(chan error, len(group.Ports))
+		for _, port := range group.Ports {
+			go udprxlib.MulticastListener(group, port, clientConf, multicastChan)
+		}
+	}
+	// capture broadcasts on each relayed port
+	for _, relay := range udprxConf.BroadcastRelays {
+		broadcastChan := make(chan error, len(relay.Ports))
+		for _, port := range relay.Ports {
+			go udprxlib.BroadcastListener(relay, port, clientConf, broadcastChan)
+		}
+	}
+	// start the stream ingress listeners
+	streamChan := make(chan error, 2)
+	if udprxConf.StreamSocket != "" {
+		go udprxlib.StreamListener("unix", udprxConf.StreamSocket, clientConf, streamChan)
+	}
+	if udprxConf.StreamTCPPort != 0 {
+		go udprxlib.StreamListener("tcp", fmt.Sprintf("127.0.0.1:%d", udprxConf.StreamTCPPort), clientConf, streamChan)
+	}
+	// start the transparent interception listener if it's configured
+	if udprxConf.TransparentPort != 0 {
+		transparentChan := make(chan error, 1)
+		go udprxlib.TransparentListener(&listenAddr, udprxConf.TransparentPort, clientConf, transparentChan)
+	}
+	// accept DTLS links from peers if it's turned on
+	if udprxConf.DTLS {
+		dtlsListenerChan := make(chan error, 1)
+		go udprxlib.DTLSListener(&listenAddr, serverConf, dtlsListenerChan)
+	}
 	return udpListenerChan, tcpListenerChan
 }
 
@@ -57,6 +99,10 @@ func (m *myservice) Execute(args []string, r <-chan svc.ChangeRequest, changes c
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
 	changes <- svc.Status{State: svc.StartPending}
 	elog.Info(startArgs, strings.Join(args, "-"))
+	// periodically log the packet and drop counters
+	go udprxlib.LogCounters(5 * time.Minute)
+	// keep the always up peers connected
+	go udprxlib.MaintainPeers(clientConf)
 	// setup error channels
 	udpListenerChan, tcpListenerChan := startNetListeners()
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
@@ -120,8 +166,13 @@ func runService(name string, isDebug bool) {
 			fmt.Println("File does not exist")
 		}
 	}
-	conf, err := udprxlib.ParseConfig(confFilePath)
-	setConfigValues(conf)
+	udprxConf, err = udprxlib.ParseConfig(confFilePath)
+	setConfigValues(udprxConf)
+	err = udprxlib.ApplyConfig(udprxConf)
+	if err != nil {
+		elog.Error(configurationFileError, fmt.Sprintf("Invalid config file. Error: %s", err.Error()))
+		return
+	}
 	// load keys
 	// load server cert as tls certs
 	cer, err := tls.LoadX509KeyPair(certPath, keyPath)
@@ -135,6 +186,8 @@ func runService(name string, isDebug bool) {
 	clientConf = &tls.Config{
 		RootCAs:      rootCAs,
 		Certificates: []tls.Certificate{cer},
+		// reconnects to a peer resume the session instead of a full handshake
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
 	}
 	// serverConf
 	serverConf = udprxlib.GetServerConfig(rootCAs, &cer)
@@ -0,0 +1,142 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchDelay is the longest a datagram waits to be batched with others into a single
+// write to a peer. 0 turns batching off and writes every datagram on its own
+var BatchDelay time.Duration
+
+// BatchSize is the number of buffered bytes that flushes a batch without waiting
+// for BatchDelay
+var BatchSize = 16384
+
+// batchWriters is a map of net.Conn to the *batchWriter for it
+var batchWriters sync.Map
+
+// batchWriter packs the frames written to a link into as few writes as possible
+type batchWriter struct {
+	conn   net.Conn
+	mutex  sync.Mutex
+	buf    []byte
+	frames uint64
+	timer  *time.Timer
+	// err is the error from a failed flush, returned by every later write
+	err error
+}
+
+// writeLink writes a frame to a link, batching it with other frames if batching is on
+// and the link is a stream. A batched frame that can't be flushed makes the next
+// write to the link fail
+func writeLink(conn net.Conn, frame []byte) (int, error) {
+	if BatchDelay <= 0 || asLink(conn).MaxWrite() > 0 {
+		return conn.Write(frame)
+	}
+	value, _ := batchWriters.LoadOrStore(conn, &batchWriter{conn: conn})
+	return value.(*batchWriter).write(frame)
+}
+
+// flushLink writes out anything batched for a link
+func flushLink(conn net.Conn) error {
+	value, ok := batchWriters.Load(conn)
+	if !ok {
+		return nil
+	}
+	return value.(*batchWriter).flush()
+}
+
+// dropLink throws away the batch writer of a link that's gone away
+func dropLink(conn net.Conn) {
+	value, ok := batchWriters.Load(conn)
+	if !ok {
+		return
+	}
+	batchWriters.Delete(conn)
+	w := value.(*batchWriter)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.frames > 0 {
+		addCounter("batch_frames_dropped", w.frames)
+	}
+	w.buf = nil
+	w.frames = 0
+}
+
+func (w *batchWriter) write(frame []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, frame...)
+	w.frames++
+	if len(w.buf) >= BatchSize {
+		err := w.flushLocked()
+		if err != nil {
+			return 0, err
+		}
+	} else if w.timer == nil {
+		w.timer = time.AfterFunc(BatchDelay, func() { w.flush() })
+	}
+	return len(frame), nil
+}
+
+func (w *batchWriter) flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.flushLocked()
+}
+
+// flushLocked writes out the batch. Callers hold the mutex
+func (w *batchWriter) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.buf) == 0 || w.err != nil {
+		return w.err
+	}
+	_, err := w.conn.Write(w.buf)
+	incCounter("batch_writes")
+	addCounter("batch_frames", w.frames)
+	w.buf = w.buf[:0]
+	w.frames = 0
+	if err != nil {
+		incCounter("batch_write_failed")
+		log.WithFields(
+			log.Fields{
+				"error":  err,
+				"remote": w.conn.RemoteAddr().String(),
+			}).Error("Error writing batch to connection")
+		w.err = err
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// readWrites returns a channel with every write made to the other end of a pipe
+func readWrites(conn net.Conn) chan []byte {
+	writes := make(chan []byte, 16)
+	go func() {
+		defer close(writes)
+		for {
+			buf := make([]byte, 65536)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			writes <- buf[:n]
+		}
+	}()
+	return writes
+}
+
+func TestBatchWriter(t *testing.T) {
+	defer func(delay time.Duration, size int) { BatchDelay, BatchSize = delay, size }(BatchDelay, BatchSize)
+	BatchDelay = 20 * time.Millisecond
+	BatchSize = 10
+	c, s := net.Pipe()
+	defer dropLink(c)
+	writes := readWrites(s)
+	// small frames wait for the delay and go out together
+	writeLink(c, []byte{1, 2, 3})
+	writeLink(c, []byte{4, 5, 6})
+	select {
+	case <-writes:
+		t.Fatal("batch shouldn't have been written before the delay")
+	case <-time.After(5 * time.Millisecond):
+	}
+	select {
+	case w := <-writes:
+		if string(w) != string([]byte{1, 2, 3, 4, 5, 6}) {
+			t.Errorf("wrong batch. Got %v", w)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch wasn't written after the delay")
+	}
+	// reaching the size threshold writes straight away
+	writeLink(c, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	select {
+	case w := <-writes:
+		if len(w) != 10 {
+			t.Errorf("wrong batch size. Got %d", len(w))
+		}
+	case <-time.After(5 * time.Millisecond):
+		t.Fatal("a full batch should have been written immediately")
+	}
+	// a failed flush fails the next write
+	s.Close()
+	writeLink(c, []byte{1, 2, 3})
+	if err := flushLink(c); err == nil {
+		t.Error("flush should have failed on a closed pipe")
+	}
+	if _, err := writeLink(c, []byte{1}); err == nil {
+		t.Error("write after a failed flush should have failed")
+	}
+}
+
+func TestWriteLinkUnbatched(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	writes := readWrites(s)
+	for i := byte(0); i < 2; i++ {
+		writeLink(c, []byte{i})
+		if w := <-writes; len(w) != 1 || w[0] != i {
+			t.Errorf("frame %d wasn't written on its own. Got %v", i, w)
+		}
+	}
+	if _, ok := batchWriters.Load(c); ok {
+		t.Error("no batch writer should be made with batching off")
+	}
+	s.Close()
+	if _, err := writeLink(c, []byte{1}); err == nil {
+		t.Error("write to a closed pipe should have failed")
+	}
+}
+
+// benchLink dials a loopback TLS link for benchmarks, and returns the client end
+// and a channel with every frame read on the server end
+func benchLink(b *testing.B) (*tls.Conn, chan linkFrame) {
+	modifyKeyPathsWindows()
+	rootCAs := ConfigureRootCAs(&cacertpath)
+	cer, err := tls.LoadX509KeyPair(certpath, keypath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cer}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	frames := make(chan linkFrame, 1024)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			frame, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "127.0.0.1"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		dropLink(conn)
+		conn.Close()
+	})
+	return conn, frames
+}
+
+// benchmarkThroughput sends b.N small data frames over a link as fast as it can
+func benchmarkThroughput(b *testing.B, delay time.Duration) {
+	defer func(d time.Duration) { BatchDelay = d }(BatchDelay)
+	BatchDelay = delay
+	conn, frames := benchLink(b)
+	// a typical status message
+	payload := make([]byte, 64)
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			<-frames
+		}
+		close(done)
+	}()
+	for i := 0; i < b.N; i++ {
+		_, err := writeLink(conn, encodeDataFrame(4000, 50300, uint32(i), payload))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	flushLink(conn)
+	<-done
+}
+
+// benchmarkLatency sends one small data frame at a time over a link and waits for it
+// to arrive, so each op is the latency of a datagram on an otherwise idle link
+func benchmarkLatency(b *testing.B, delay time.Duration) {
+	defer func(d time.Duration) { BatchDelay = d }(BatchDelay)
+	BatchDelay = delay
+	conn, frames := benchLink(b)
+	payload := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := writeLink(conn, encodeDataFrame(4000, 50300, uint32(i), payload))
+		if err != nil {
+			b.Fatal(err)
+		}
+		<-frames
+	}
+}
+
+func BenchmarkThroughputUnbatched(b *testing.B) {
+	benchmarkThroughput(b, 0)
+}
+
+func BenchmarkThroughputBatched(b *testing.B) {
+	benchmarkThroughput(b, time.Millisecond)
+}
+
+func BenchmarkLatencyUnbatched(b *testing.B) {
+	benchmarkLatency(b, 0)
+}
+
+func BenchmarkLatencyBatched(b *testing.B) {
+	benchmarkLatency(b, time.Millisecond)
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+)
+
+// BroadcastRelay relays subnet broadcasts on some UDP ports between udp_rx peers. Both
+// sides of the tunnel configure the relay with each other as peers
+type BroadcastRelay struct {
+	// Ports are the UDP ports broadcasts are relayed for
+	Ports []int `json:"ports"`
+	// Interface is the local interface to capture broadcasts on and re-broadcast to
+	Interface string `json:"interface"`
+	// Peers are the udp_rx peers (IP addresses or hostnames) broadcasts are relayed to
+	Peers []string `json:"peers"`
+}
+
+// broadcastRelays are the configured relays, set by ApplyConfig
+var broadcastRelays []BroadcastRelay
+
+// broadcastListeners is a map of "interface:port" strings to the *net.UDPConn listening on them
+var broadcastListeners = sync.Map{}
+
+// hasPort returns true if broadcasts on the port are relayed
+func (relay *BroadcastRelay) hasPort(port int) bool {
+	for _, p := range relay.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPeer returns true if ip is the address of one of the relay's peers
+func (relay *BroadcastRelay) hasPeer(ip string) bool {
+	return peersInclude(relay.Peers, ip)
+}
+
+// broadcastRelayFor returns the relay that a packet from a peer to destport belongs to,
+// or nil if it should be delivered as unicast
+func broadcastRelayFor(remoteIP string, destport uint) *BroadcastRelay {
+	for i := range broadcastRelays {
+		relay := &broadcastRelays[i]
+		if relay.hasPort(int(destport)) && relay.hasPeer(remoteIP) {
+			return relay
+		}
+	}
+	return nil
+}
+
+// directedBroadcast returns the subnet broadcast address of an IPv4 network, or nil
+func directedBroadcast(ipnet *net.IPNet) net.IP {
+	ip := ipnet.IP.To4()
+	if ip == nil || len(ipnet.Mask) != net.IPv4len {
+		return nil
+	}
+	bcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		bcast[i] = ip[i] | ^ipnet.Mask[i]
+	}
+	return bcast
+}
+
+// interfaceBroadcasts returns the subnet broadcast addresses of the named interface, or
+// of every interface if ifname is empty
+func interfaceBroadcasts(ifname string) ([]net.IP, error) {
+	var ifaces []net.Interface
+	if ifname != "" {
+		ifi, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = []net.Interface{*ifi}
+	} else {
+		var err error
+		ifaces, err = net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var bcasts []net.IP
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if bcast := directedBroadcast(ipnet); bcast != nil {
+				bcasts = append(bcasts, bcast)
+			}
+		}
+	}
+	return bcasts, nil
+}
+
+// broadcastBindAddrs returns the addresses broadcasts are captured on: the limited
+// broadcast address and each subnet broadcast address of the relay's interface
+func broadcastBindAddrs(relay *BroadcastRelay) ([]net.IP, error) {
+	bcasts, err := interfaceBroadcasts(relay.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []net.IP{net.IPv4bcast}
+	for _, bcast := range bcasts {
+		seen := false
+		for _, addr := range addrs {
+			if addr.Equal(bcast) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			addrs = append(addrs, bcast)
+		}
+	}
+	return addrs, nil
+}
+
+// relayBroadcastAddr returns the address a relayed broadcast is re-broadcast to. That's
+// the subnet broadcast of the relay's interface, or the limited broadcast if it has none
+func relayBroadcastAddr(relay *BroadcastRelay) (net.IP, error) {
+	if relay.Interface == "" {
+		return net.IPv4bcast, nil
+	}
+	bcasts, err := interfaceBroadcasts(relay.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if len(bcasts) == 0 {
+		return nil, errors.New("relay interface has no IPv4 address")
+	}
+	return bcasts[0], nil
+}
+
+// forwardBroadcast sends a captured broadcast to every peer of the relay
+func forwardBroadcast(clientConf *tls.Config, relay *BroadcastRelay, port int, data []byte, srcIP net.IP, srcport int) {
+	for _, peer := range relay.Peers {
+		header := peerHeader(UDPRxHeader{MajorVersion: 2, PortNumber: port}, peer)
+		dispatchPacket(clientConf, header, data, srcIP, srcport)
+	}
+}
+
+// deliverBroadcast re-broadcasts a packet from a peer on the relay's subnet, with the
+// original sender as the source
+func deliverBroadcast(relay *BroadcastRelay, remoteIP string, srcport uint, destport uint, data []byte) error {
+	bcast, err := relayBroadcastAddr(relay)
+	if err != nil {
+		return err
+	}
+	rememberRelayed(relayKey(remoteIP, srcport, bcast.String(), destport, data))
+	return SendUDP(remoteIP, bcast.String(), srcport, destport, data, 0)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestDirectedBroadcast(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("192.168.1.77/24")
+	if bcast := directedBroadcast(ipnet); bcast.String() != "192.168.1.255" {
+		t.Errorf("wrong broadcast address. Got %v", bcast)
+	}
+	_, ipnet, _ = net.ParseCIDR("10.20.0.0/14")
+	if bcast := directedBroadcast(ipnet); bcast.String() != "10.23.255.255" {
+		t.Errorf("wrong broadcast address. Got %v", bcast)
+	}
+	_, ipnet, _ = net.ParseCIDR("fe80::1/64")
+	if bcast := directedBroadcast(ipnet); bcast != nil {
+		t.Errorf("IPv6 has no broadcast address. Got %v", bcast)
+	}
+}
+
+func TestBroadcastRelayLookup(t *testing.T) {
+	broadcastRelays = []BroadcastRelay{
+		{Ports: []int{30303}, Peers: []string{"192.168.2.250"}},
+	}
+	defer func() { broadcastRelays = nil }()
+	if broadcastRelayFor("192.168.2.250", 30303) == nil {
+		t.Error("packet from a peer to a relayed port should be broadcast")
+	}
+	if broadcastRelayFor("192.168.2.250", 30304) != nil {
+		t.Error("port isn't relayed")
+	}
+	if broadcastRelayFor("192.168.3.250", 30303) != nil {
+		t.Error("packet from a non-peer should be unicast")
+	}
+}
+
+func TestForwardBroadcast(t *testing.T) {
+	relay := BroadcastRelay{Ports: []int{30303}, Peers: []string{"192.168.1.50", "192.168.2.50"}}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var peers []string
+	wg.Add(2)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		mutex.Lock()
+		peers = append(peers, header.DestIPAddr.String())
+		mutex.Unlock()
+		if header.PortNumber != 30303 || srcprt != 4000 {
+			t.Errorf("wrong ports. Got %d and %d", header.PortNumber, srcprt)
+		}
+		wg.Done()
+		return nil
+	}
+	defer func() { forwardPacketFunc = forwardPacket }()
+	forwardBroadcast(&tls.Config{}, &relay, 30303, []byte{1, 2, 3}, net.IPv4(192, 168, 1, 2), 4000)
+	wg.Wait()
+	sort.Strings(peers)
+	if len(peers) != 2 || peers[0] != "192.168.1.50" || peers[1] != "192.168.2.50" {
+		t.Errorf("broadcast should have gone to both peers. Got %v", peers)
+	}
+}
@@ -43,6 +43,13 @@ func GetServerConfig(rcas *x509.CertPool, sc *tls.Certificate) *tls.Config {
 			return serverCert, nil
 		},
 		GetConfigForClient: func(hi *tls.ClientHelloInfo) (*tls.Config, error) {
+			// the handshake itself refuses the peer, but say why
+			if _, err := commonLinkProtocol(hi.SupportedProtos); err != nil {
+				log.WithFields(log.Fields{
+					"error":  err,
+					"remote": hi.Conn.RemoteAddr().String(),
+				}).Error("Refusing peer with an incompatible link protocol")
+			}
 			serverConf := &tls.Config{
 				GetCertificate: func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 					return serverCert, nil
@@ -52,10 +59,14 @@ func GetServerConfig(rcas *x509.CertPool, sc *tls.Certificate) *tls.Config {
 				ClientAuth:	tls.RequireAndVerifyClientCert,
 				ClientCAs:  rootCAs,
 				VerifyPeerCertificate: getClientValidator(hi),
+				VerifyConnection: getConnectionVerifier(hi),
+				NextProtos: linkProtocols,
 			}
 			return serverConf, nil
 		},
 	}
+	// sessions are resumed with tickets encrypted by the outer config's keys
+	startSessionTicketRotation(serverConf)
 	return serverConf
 }
 
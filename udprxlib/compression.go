@@ -0,0 +1,147 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CompressionDeflate is the per-peer setting for DEFLATE compressed payloads
+const CompressionDeflate = "deflate"
+
+// compression algorithm IDs in settings frames
+const (
+	compressIDDeflate = 0x01
+)
+
+// supportedCompression are the algorithms we can decompress, sent to every peer
+var supportedCompression = []byte{compressIDDeflate}
+
+// linkCompression is a map of net.Conn to the algorithm ID payloads sent on the link
+// are compressed with. Links that aren't in it aren't compressed
+var linkCompression sync.Map
+
+// flateWriters reuses DEFLATE compressors, which are expensive to set up
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// errDecompressedTooLarge is returned for a payload that decompresses to more than
+// MaxDatagramSize bytes
+var errDecompressedTooLarge = errors.New("decompressed payload is too large")
+
+// validCompression returns an error if name isn't a known compression setting
+func validCompression(name string) error {
+	if name != CompressionDeflate {
+		return fmt.Errorf("unknown compression %q", name)
+	}
+	return nil
+}
+
+// wantsCompression returns true if we're configured to compress payloads to the
+// peer at remoteIP
+func wantsCompression(remoteIP string) bool {
+	peer := peerConfFor(UDPRxHeader{DestIPAddr: net.ParseIP(remoteIP)})
+	return peer != nil && peer.Compression == CompressionDeflate
+}
+
+// encodeSettingsFrame builds the settings frame sent when a link opens
+func encodeSettingsFrame() []byte {
+	return encodeFrame(frameTypeSettings, 0, supportedCompression)
+}
+
+// handleSettingsFrame turns on compression for a link if we want it and the peer
+// can decompress it
+func handleSettingsFrame(conn net.Conn, frame linkFrame) {
+	remoteIP := addrIP(conn.RemoteAddr())
+	if !wantsCompression(remoteIP) {
+		return
+	}
+	if bytes.IndexByte(frame.Body, compressIDDeflate) < 0 {
+		log.WithField("remote", remoteIP).Warn("Peer can't decompress payloads, sending them uncompressed")
+		return
+	}
+	linkCompression.Store(conn, byte(compressIDDeflate))
+	log.WithField("remote", remoteIP).Info("Compressing payloads to peer")
+}
+
+// compressPayload compresses a payload for a link if compression was negotiated for
+// it, returning the payload to send and whether it was compressed. Payloads that
+// don't get smaller are sent as they are
+func compressPayload(conn net.Conn, data []byte) ([]byte, bool) {
+	if _, ok := linkCompression.Load(conn); !ok {
+		return data, false
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	flateWriters.Put(w)
+	remoteIP := addrIP(conn.RemoteAddr())
+	addCounter(fmt.Sprintf("compress_bytes_in:%s", remoteIP), uint64(len(data)))
+	if buf.Len() >= len(data) {
+		incCounter("compress_skipped")
+		addCounter(fmt.Sprintf("compress_bytes_out:%s", remoteIP), uint64(len(data)))
+		return data, false
+	}
+	incCounter("compressed_frames")
+	addCounter(fmt.Sprintf("compress_bytes_out:%s", remoteIP), uint64(buf.Len()))
+	return buf.Bytes(), true
+}
+
+// decompressPayload inflates a compressed payload from a peer
+func decompressPayload(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	// don't let a small payload inflate into an unbounded one
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(MaxDatagramSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxDatagramSize {
+		return nil, errDecompressedTooLarge
+	}
+	return out, nil
+}
+
+// encodeLinkDataFrame builds a data frame for a link, compressing the payload if
+// compression was negotiated for it. group is the multicast group the data is for,
+// or nil, and source is the local sender of a multicast packet
+func encodeLinkDataFrame(conn net.Conn, srcprt int, destport int, seq uint32, group net.IP, source net.IP, data []byte) []byte {
+	payload, compressed := compressPayload(conn, data)
+	flags := byte(frameFlagSequenced)
+	if compressed {
+		flags |= frameFlagCompressed
+	}
+	return encodePayloadFrame(flags, srcprt, destport, seq, group, source, payload)
+}
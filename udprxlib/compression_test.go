@@ -0,0 +1,127 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCompressPayload(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	status := []byte(`{"car": 1, "floor": 12, "door": "closed", "direction": "up", "load": 40}` +
+		`{"car": 2, "floor": 3, "door": "closed", "direction": "down", "load": 10}`)
+	if payload, compressed := compressPayload(c, status); compressed || !bytes.Equal(payload, status) {
+		t.Error("payload shouldn't be compressed before it's negotiated")
+	}
+	linkCompression.Store(c, byte(compressIDDeflate))
+	defer linkCompression.Delete(c)
+	payload, compressed := compressPayload(c, status)
+	if !compressed || len(payload) >= len(status) {
+		t.Fatalf("status message should have been compressed. Got %d bytes from %d", len(payload), len(status))
+	}
+	data, err := decompressPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, status) {
+		t.Errorf("wrong decompressed payload. Got %s", data)
+	}
+	// a payload that doesn't get smaller goes as it is
+	if _, compressed := compressPayload(c, []byte{7}); compressed {
+		t.Error("payload that doesn't shrink shouldn't be compressed")
+	}
+}
+
+func TestDecompressPayloadLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(make([]byte, MaxDatagramSize+1))
+	w.Close()
+	if _, err := decompressPayload(buf.Bytes()); err != errDecompressedTooLarge {
+		t.Errorf("payload that inflates past the max should be refused. Got %v", err)
+	}
+	if _, err := decompressPayload([]byte{0xFF, 0xFF, 0xFF}); err == nil {
+		t.Error("garbage payload should fail to decompress")
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	mem, handle := useMemTransport(t, []PeerConf{{Address: "192.168.7.6", Transport: "mem", Compression: CompressionDeflate}})
+	ln, err := mem.Listen("192.168.7.6:55554", &tls.Config{NextProtos: linkProtocols})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	delivered := make(chan []byte, 1)
+	sender := func(srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte, counter int) error {
+		delivered <- append([]byte{}, data...)
+		return nil
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			handle(conn, sender)
+		}
+	}()
+	header := UDPRxHeader{MajorVersion: 1, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.7.6")}
+	defer removeConn(header)
+	conn, err := getConn(header, &tls.Config{}, ":55554")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compression starts once the peer's settings arrive
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := linkCompression.Load(conn); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("compression wasn't negotiated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	before := GetCounters()["decompressed_frames"]
+	status := bytes.Repeat([]byte("door closed, floor 12. "), 10)
+	err = forwardPacket(&tls.Config{}, header, status, 4000, ":55554")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-delivered:
+		if !bytes.Equal(data, status) {
+			t.Errorf("wrong delivered payload. Got %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet wasn't delivered")
+	}
+	if GetCounters()["decompressed_frames"] != before+1 {
+		t.Error("payload should have been sent compressed")
+	}
+	if GetCounters()["compress_bytes_out:192.168.7.6"] >= GetCounters()["compress_bytes_in:192.168.7.6"] {
+		t.Error("compression counters should show the payload shrinking")
+	}
+}
@@ -2,8 +2,11 @@ package udprxlib
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"time"
 )
 
 // ConfFile represents the config file struct
@@ -12,6 +15,70 @@ type ConfFile struct {
 	KeyPath    string `json:"keyPath"`
 	CertPath   string `json:"certPath"`
 	CaCertPath string `json:"caCertPath"`
+	// DNSCacheTTL is the number of seconds to cache resolved hostnames for
+	DNSCacheTTL int `json:"dnsCacheTTL"`
+	// MaxDatagramSize is the largest payload in bytes that will be tunneled
+	MaxDatagramSize int `json:"maxDatagramSize"`
+	// StaticTunnels are header-less tunnels from a local port to a remote peer
+	StaticTunnels []StaticTunnel `json:"staticTunnels"`
+	// TransparentPort is the port TPROXY redirects intercepted datagrams to. 0 disables it
+	TransparentPort int `json:"transparentPort"`
+	// MulticastGroups are the multicast groups forwarded to and from peers
+	MulticastGroups []MulticastGroup `json:"multicastGroups"`
+	// BroadcastRelays are the subnet broadcasts relayed to and from peers
+	BroadcastRelays []BroadcastRelay `json:"broadcastRelays"`
+	// DestinationGroups are named lists of destinations that a header can fan out to
+	DestinationGroups map[string][]string `json:"destinationGroups"`
+	// IngressRules restrict which local senders can use the ingress port. Empty allows all
+	IngressRules []IngressRule `json:"ingressRules"`
+	// StreamSocket is the path of the unix socket for stream ingress. Empty disables it
+	StreamSocket string `json:"streamSocket"`
+	// StreamSocketMode is the octal file mode of the stream socket, like "0660"
+	StreamSocketMode string `json:"streamSocketMode"`
+	// StreamTCPPort is the loopback TCP port for stream ingress. 0 disables it
+	StreamTCPPort int `json:"streamTCPPort"`
+	// TLSPort is the port of the local TLS server. 0 uses the default, 55554
+	TLSPort int `json:"tlsPort"`
+	// UDPPort is the local UDP ingress port. 0 uses the default, 55555
+	UDPPort int `json:"udpPort"`
+	// RemotePort is the default TLS port of peers. 0 uses the default, 55554
+	RemotePort int `json:"remotePort"`
+	// DTLS accepts DTLS links from peers on UDP port TLSPort as well as TLS links
+	DTLS bool `json:"dtls"`
+	// ConnectionsPerPeer is the number of connections flows to each peer are spread over
+	ConnectionsPerPeer int `json:"connectionsPerPeer"`
+	// Peers are per-peer settings
+	Peers []PeerConf `json:"peers"`
+	// BackoffMin is how long a peer is left alone after a failed dial, like "1s"
+	BackoffMin string `json:"backoffMin"`
+	// BackoffMax is the longest a peer is left alone after failed dials, like "2m"
+	BackoffMax string `json:"backoffMax"`
+	// SessionTicketRotation is the number of seconds between TLS session ticket key
+	// rotations
+	SessionTicketRotation int `json:"sessionTicketRotation"`
+	// KeepaliveInterval is the number of seconds between pings on a link
+	KeepaliveInterval int `json:"keepaliveInterval"`
+	// KeepaliveTimeout is the number of seconds a link can be silent before it's evicted
+	KeepaliveTimeout int `json:"keepaliveTimeout"`
+	// ReplySessions tunnels replies to delivered packets back to the sender. Linux only
+	ReplySessions bool `json:"replySessions"`
+	// SessionIdleTimeout is the number of seconds a reply session lasts without traffic
+	SessionIdleTimeout int `json:"sessionIdleTimeout"`
+	// QueueDepth is the most packets that can wait to be sent to a single peer
+	QueueDepth int `json:"queueDepth"`
+	// QueueDropPolicy is "dropOldest" or "dropNewest", for packets to a full queue
+	QueueDropPolicy string `json:"queueDropPolicy"`
+	// PendingDepth is the most packets that can wait for a connection to a single peer
+	PendingDepth int `json:"pendingDepth"`
+	// PendingMaxAge is how long a packet can wait for a connection to its peer, like
+	// "5s". "0s" drops them straight away
+	PendingMaxAge string `json:"pendingMaxAge"`
+	// StrictOrderPorts are destination ports whose out of order packets are dropped
+	StrictOrderPorts []int `json:"strictOrderPorts"`
+	// BatchDelay is how long a datagram can wait to be batched, like "1ms". Empty is off
+	BatchDelay string `json:"batchDelay"`
+	// BatchSize is the number of batched bytes that are written without waiting
+	BatchSize int `json:"batchSize"`
 }
 
 // ParseConfig parses a ConfFile into it's struct
@@ -29,3 +96,151 @@ func ParseConfig(path string) (ConfFile, error) {
 	err = json.Unmarshal(byteValue, &conf)
 	return conf, nil
 }
+
+// ApplyConfig sets the library wide settings from a parsed ConfFile. Settings that
+// are missing from the file keep their defaults
+func ApplyConfig(conf ConfFile) error {
+	rules, err := parseIngressRules(conf.IngressRules)
+	if err != nil {
+		return err
+	}
+	err = validatePeerConfs(conf.Peers)
+	if err != nil {
+		return err
+	}
+	if conf.ConnectionsPerPeer != 0 {
+		if conf.ConnectionsPerPeer < 0 || conf.ConnectionsPerPeer > maxConnectionsPerPeer {
+			return fmt.Errorf("invalid connections per peer %d", conf.ConnectionsPerPeer)
+		}
+		ConnectionsPerPeer = conf.ConnectionsPerPeer
+	}
+	if conf.TLSPort != 0 {
+		if err := validPort("tls port", conf.TLSPort); err != nil {
+			return err
+		}
+		TLSListenPort = conf.TLSPort
+	}
+	if conf.UDPPort != 0 {
+		if err := validPort("udp port", conf.UDPPort); err != nil {
+			return err
+		}
+		UDPListenPort = conf.UDPPort
+	}
+	if conf.RemotePort != 0 {
+		if err := validPort("remote port", conf.RemotePort); err != nil {
+			return err
+		}
+		RemoteTLSPort = fmt.Sprintf(":%d", conf.RemotePort)
+	}
+	if conf.BackoffMin != "" {
+		backoff, err := time.ParseDuration(conf.BackoffMin)
+		if err != nil {
+			return err
+		}
+		if backoff <= 0 {
+			return fmt.Errorf("invalid backoff min %s", conf.BackoffMin)
+		}
+		BackoffMin = backoff
+	}
+	if conf.BackoffMax != "" {
+		backoff, err := time.ParseDuration(conf.BackoffMax)
+		if err != nil {
+			return err
+		}
+		BackoffMax = backoff
+	}
+	if BackoffMax < BackoffMin {
+		return fmt.Errorf("backoff max must be at least the backoff min")
+	}
+	if conf.SessionTicketRotation > 0 {
+		SessionTicketRotation = time.Duration(conf.SessionTicketRotation) * time.Second
+	}
+	if conf.KeepaliveInterval > 0 {
+		KeepaliveInterval = time.Duration(conf.KeepaliveInterval) * time.Second
+	}
+	if conf.KeepaliveTimeout > 0 {
+		KeepaliveTimeout = time.Duration(conf.KeepaliveTimeout) * time.Second
+	}
+	if KeepaliveTimeout <= KeepaliveInterval {
+		return fmt.Errorf("keepalive timeout must be longer than the keepalive interval")
+	}
+	if conf.QueueDepth > 0 {
+		QueueDepth = conf.QueueDepth
+	}
+	switch conf.QueueDropPolicy {
+	case "":
+	case DropOldest, DropNewest:
+		QueueDropPolicy = conf.QueueDropPolicy
+	default:
+		return fmt.Errorf("invalid queue drop policy %q", conf.QueueDropPolicy)
+	}
+	if conf.PendingDepth > 0 {
+		PendingDepth = conf.PendingDepth
+	}
+	if conf.PendingMaxAge != "" {
+		age, err := time.ParseDuration(conf.PendingMaxAge)
+		if err != nil {
+			return err
+		}
+		if age < 0 {
+			return fmt.Errorf("invalid pending max age %s", conf.PendingMaxAge)
+		}
+		PendingMaxAge = age
+	}
+	if conf.BatchDelay != "" {
+		delay, err := time.ParseDuration(conf.BatchDelay)
+		if err != nil {
+			return err
+		}
+		if delay < 0 {
+			return fmt.Errorf("invalid batch delay %s", conf.BatchDelay)
+		}
+		BatchDelay = delay
+	}
+	if conf.BatchSize > 0 {
+		BatchSize = conf.BatchSize
+	}
+	for _, port := range conf.StrictOrderPorts {
+		if err := validPort("strict order port", port); err != nil {
+			return err
+		}
+	}
+	if conf.StreamSocketMode != "" {
+		mode, err := strconv.ParseUint(conf.StreamSocketMode, 8, 32)
+		if err != nil {
+			return err
+		}
+		StreamSocketMode = os.FileMode(mode)
+	}
+	if conf.DNSCacheTTL > 0 {
+		DNSCacheTTL = time.Duration(conf.DNSCacheTTL) * time.Second
+	}
+	// a UDP payload can never be larger than 65507 bytes
+	if conf.MaxDatagramSize != 0 {
+		if conf.MaxDatagramSize < 0 || conf.MaxDatagramSize > 65507 {
+			return fmt.Errorf("invalid max datagram size %d", conf.MaxDatagramSize)
+		}
+		MaxDatagramSize = conf.MaxDatagramSize
+	}
+	if usesDTLS(conf) && MaxDatagramSize > dtlsMaxDatagram {
+		return fmt.Errorf("maxDatagramSize must be at most %d bytes when DTLS is used", dtlsMaxDatagram)
+	}
+	multicastGroups = conf.MulticastGroups
+	for _, group := range multicastGroups {
+		prefetchHosts(group.Peers)
+	}
+	broadcastRelays = conf.BroadcastRelays
+	for _, relay := range broadcastRelays {
+		prefetchHosts(relay.Peers)
+	}
+	destinationGroups = conf.DestinationGroups
+	ReplySessions = conf.ReplySessions
+	if conf.SessionIdleTimeout > 0 {
+		SessionIdleTimeout = time.Duration(conf.SessionIdleTimeout) * time.Second
+	}
+	StrictOrderPorts = conf.StrictOrderPorts
+	peerConfs = conf.Peers
+	prefetchHosts(peerAddresses(peerConfs))
+	ingressRules = rules
+	return nil
+}
@@ -21,4 +21,7 @@ func TestParseConfig(t *testing.T) {
 	if conf.CaCertPath != "/etc/udp_rx/ca.crt" {
 		t.Errorf("Wrong ca path. Path: %s", conf.CaCertPath)
 	}
+	if conf.DNSCacheTTL != 60 {
+		t.Errorf("Wrong dns cache ttl. Value: %d", conf.DNSCacheTTL)
+	}
 }
@@ -29,3 +29,13 @@ type connTimeoutError struct {
 func (e *connTimeoutError) Error() string {
 	return fmt.Sprintf("connection has timed out")
 }
+
+// peerUnavailableError is returned by forwardPacket when there's no connection to the
+// peer and one couldn't be made, so nothing was sent
+type peerUnavailableError struct {
+	err error
+}
+
+func (e *peerUnavailableError) Error() string {
+	return e.err.Error()
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// counters is a map of counter names to *uint64 event counts
+var counters = sync.Map{}
+
+// incCounter adds one to the named counter
+func incCounter(name string) {
+	addCounter(name, 1)
+}
+
+// addCounter adds delta to the named counter, creating it if needed
+func addCounter(name string, delta uint64) {
+	c, ok := counters.Load(name)
+	if !ok {
+		c, _ = counters.LoadOrStore(name, new(uint64))
+	}
+	atomic.AddUint64(c.(*uint64), delta)
+}
+
+// GetCounters returns a snapshot of all of the event counters
+func GetCounters() map[string]uint64 {
+	snapshot := make(map[string]uint64)
+	counters.Range(func(key, value interface{}) bool {
+		snapshot[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return snapshot
+}
+
+// LogCounters logs a snapshot of the event counters at info level every interval.
+// It never returns, so it should be run in its own go routine
+func LogCounters(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		fields := log.Fields{}
+		for name, value := range GetCounters() {
+			fields[name] = value
+		}
+		log.WithFields(fields).Info("udp_rx counters")
+	}
+}
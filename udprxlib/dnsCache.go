@@ -0,0 +1,197 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNSCacheTTL is the longest a resolved hostname is cached for. Hostnames are cached
+// for the TTL of their records when it's shorter, or for this when it isn't known
+var DNSCacheTTL = 60 * time.Second
+
+// DNSFailureTTL is how long a failed lookup is cached for before trying again
+var DNSFailureTTL = 5 * time.Second
+
+// DNSCacheSize is the most hostnames the DNS cache holds
+var DNSCacheSize = 1024
+
+// dnsCache is a map of hostnames to *dnsCacheEntry
+var dnsCache = make(map[string]*dnsCacheEntry)
+var dnsCacheMutex = &sync.Mutex{}
+var lookupIPFunc = lookupIPTTL
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// dnsLookups is a map of the hostnames being looked up in the background to the
+// callbacks waiting for them, in the order they arrived
+var dnsLookups = make(map[string][]func())
+var dnsLookupsMutex = &sync.Mutex{}
+
+// cachedHost returns true if the addresses of a hostname are cached and haven't expired
+func cachedHost(hostname string) bool {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	entry, ok := dnsCache[hostname]
+	return ok && time.Now().Before(entry.expires)
+}
+
+// cachedHostIPs returns the cached addresses of a hostname without waiting for DNS,
+// even if they've expired. A hostname that isn't cached or has expired is looked up
+// in the background, so later calls see its new addresses
+func cachedHostIPs(hostname string) []net.IP {
+	dnsCacheMutex.Lock()
+	entry, ok := dnsCache[hostname]
+	dnsCacheMutex.Unlock()
+	if !ok || !time.Now().Before(entry.expires) {
+		whenResolved(hostname, func() {})
+	}
+	if !ok {
+		return nil
+	}
+	return entry.ips
+}
+
+// prefetchHosts looks up the hostnames in a list of peers in the background, so their
+// addresses are cached before packets need them
+func prefetchHosts(peers []string) {
+	for _, peer := range peers {
+		if net.ParseIP(peer) == nil {
+			whenResolved(peer, func() {})
+		}
+	}
+}
+
+// storeHost caches the result of looking up a hostname. Expired entries are evicted
+// when the cache is full, then the ones closest to expiring
+func storeHost(hostname string, entry *dnsCacheEntry) {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	if _, ok := dnsCache[hostname]; !ok && len(dnsCache) >= DNSCacheSize {
+		now := time.Now()
+		for name, cached := range dnsCache {
+			if !now.Before(cached.expires) {
+				delete(dnsCache, name)
+			}
+		}
+		for len(dnsCache) >= DNSCacheSize {
+			var soonest string
+			for name, cached := range dnsCache {
+				if soonest == "" || cached.expires.Before(dnsCache[soonest].expires) {
+					soonest = name
+				}
+			}
+			delete(dnsCache, soonest)
+		}
+	}
+	dnsCache[hostname] = entry
+}
+
+// whenResolved calls done once the result of looking up a hostname is cached. A
+// cached hostname calls it straight away. Otherwise the lookup runs in its own go
+// routine and done is called from there, after anything else that was waiting for
+// the same hostname so packets to it stay in order
+func whenResolved(hostname string, done func()) {
+	dnsLookupsMutex.Lock()
+	waiting, running := dnsLookups[hostname]
+	if !running && cachedHost(hostname) {
+		dnsLookupsMutex.Unlock()
+		done()
+		return
+	}
+	dnsLookups[hostname] = append(waiting, done)
+	dnsLookupsMutex.Unlock()
+	if running {
+		return
+	}
+	go func() {
+		resolveHost(hostname)
+		// hand on everything that arrived during the lookup, and anything that arrives
+		// while that's happening, before later packets can skip the queue
+		for {
+			dnsLookupsMutex.Lock()
+			waiting := dnsLookups[hostname]
+			if len(waiting) == 0 {
+				delete(dnsLookups, hostname)
+				dnsLookupsMutex.Unlock()
+				return
+			}
+			dnsLookups[hostname] = nil
+			dnsLookupsMutex.Unlock()
+			for _, done := range waiting {
+				done()
+			}
+		}
+	}()
+}
+
+// resolveHeader resolves the DestHostname of a header into its DestIPAddr, preferring
+// an address in the same family as the source IP if one was given
+func resolveHeader(header *UDPRxHeader) error {
+	ips, err := resolveHost(header.DestHostname)
+	if err != nil {
+		return err
+	}
+	wantV4 := len(header.SourceIPAddr) == 0 || header.SourceIPAddr.To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == wantV4 {
+			header.DestIPAddr = ip
+			return nil
+		}
+	}
+	if len(header.SourceIPAddr) > 0 {
+		return errors.New("no address for hostname matches the source IP version")
+	}
+	header.DestIPAddr = ips[0]
+	return nil
+}
+
+// resolveHost returns the addresses for a hostname, using the cached result if it
+// hasn't expired
+func resolveHost(hostname string) ([]net.IP, error) {
+	dnsCacheMutex.Lock()
+	entry, ok := dnsCache[hostname]
+	dnsCacheMutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, entry.err
+	}
+	ips, ttl, err := lookupIPFunc(hostname)
+	if err == nil && len(ips) == 0 {
+		err = errors.New("no addresses found for hostname")
+	}
+	entry = &dnsCacheEntry{ips: ips, err: err}
+	if err != nil {
+		entry.ips = nil
+		entry.expires = time.Now().Add(DNSFailureTTL)
+	} else if ttl > 0 && ttl < DNSCacheTTL {
+		entry.expires = time.Now().Add(ttl)
+	} else {
+		entry.expires = time.Now().Add(DNSCacheTTL)
+	}
+	storeHost(hostname, entry)
+	return entry.ips, entry.err
+}
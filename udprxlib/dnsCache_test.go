@@ -0,0 +1,175 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+package udprxlib
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var lookupCount int
+
+func mockLookupIP(host string) ([]net.IP, time.Duration, error) {
+	lookupCount++
+	if host == "controller1.example" {
+		return []net.IP{net.ParseIP("fd00::10"), net.IPv4(192, 168, 1, 10)}, 0, nil
+	}
+	return nil, 0, errors.New("no such host")
+}
+
+func forgetHost(hostname string) {
+	dnsCacheMutex.Lock()
+	delete(dnsCache, hostname)
+	dnsCacheMutex.Unlock()
+}
+
+func TestResolveHeader(t *testing.T) {
+	lookupIPFunc = mockLookupIP
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	forgetHost("controller1.example")
+	lookupCount = 0
+	header := UDPRxHeader{DestHostname: "controller1.example"}
+	err := resolveHeader(&header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.DestIPAddr.String() != "192.168.1.10" {
+		t.Errorf("should have preferred the IPv4 address. Got %s", header.DestIPAddr.String())
+	}
+	// an IPv6 source should pick the IPv6 address, from the cache
+	header = UDPRxHeader{DestHostname: "controller1.example", SourceIPAddr: net.ParseIP("fd00::2")}
+	err = resolveHeader(&header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.DestIPAddr.String() != "fd00::10" {
+		t.Errorf("should have picked the IPv6 address. Got %s", header.DestIPAddr.String())
+	}
+	if lookupCount != 1 {
+		t.Errorf("second resolve should have been cached. Lookups: %d", lookupCount)
+	}
+}
+
+func TestResolveHostExpiry(t *testing.T) {
+	lookupIPFunc = mockLookupIP
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	oldTTL := DNSFailureTTL
+	DNSFailureTTL = 0
+	defer func() { DNSFailureTTL = oldTTL }()
+	lookupCount = 0
+	_, err := resolveHost("missing.example")
+	if err == nil {
+		t.Error("should have failed to resolve")
+	}
+	time.Sleep(time.Millisecond)
+	resolveHost("missing.example")
+	if lookupCount != 2 {
+		t.Errorf("expired failure should have been looked up again. Lookups: %d", lookupCount)
+	}
+}
+
+func TestWhenResolved(t *testing.T) {
+	release := make(chan bool)
+	lookupIPFunc = func(host string) ([]net.IP, time.Duration, error) {
+		<-release
+		return []net.IP{net.IPv4(192, 168, 1, 20)}, 0, nil
+	}
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	forgetHost("slow.example")
+	defer forgetHost("slow.example")
+	order := make(chan int, 3)
+	// a slow lookup doesn't hold up the caller, and later packets wait behind it
+	for i := 0; i < 2; i++ {
+		i := i
+		whenResolved("slow.example", func() { order <- i })
+	}
+	if len(order) != 0 {
+		t.Fatal("callbacks shouldn't run before the lookup finishes")
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-order:
+			if got != i {
+				t.Errorf("callbacks out of order. Got %d, expected %d", got, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("callback wasn't called after the lookup")
+		}
+	}
+	// once it's cached and the lookup is done the callback runs straight away
+	for {
+		dnsLookupsMutex.Lock()
+		_, running := dnsLookups["slow.example"]
+		dnsLookupsMutex.Unlock()
+		if !running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	whenResolved("slow.example", func() { order <- 2 })
+	if len(order) != 1 {
+		t.Error("cached hostname should have called back straight away")
+	}
+}
+
+func TestResolveHostTTL(t *testing.T) {
+	lookupIPFunc = func(host string) ([]net.IP, time.Duration, error) {
+		return []net.IP{net.IPv4(192, 168, 1, 30)}, 5 * time.Second, nil
+	}
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	forgetHost("short.example")
+	defer forgetHost("short.example")
+	resolveHost("short.example")
+	dnsCacheMutex.Lock()
+	expires := dnsCache["short.example"].expires
+	dnsCacheMutex.Unlock()
+	if time.Until(expires) > 5*time.Second {
+		t.Errorf("should have been cached for the record's TTL. Expires in %s", time.Until(expires))
+	}
+}
+
+func TestDNSCacheSize(t *testing.T) {
+	lookupIPFunc = func(host string) ([]net.IP, time.Duration, error) {
+		return []net.IP{net.IPv4(192, 168, 1, 40)}, 0, nil
+	}
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	oldSize := DNSCacheSize
+	DNSCacheSize = 2
+	defer func() { DNSCacheSize = oldSize }()
+	dnsCacheMutex.Lock()
+	dnsCache = map[string]*dnsCacheEntry{
+		"expired.example": {expires: time.Now().Add(-time.Second)},
+		"later.example":   {expires: time.Now().Add(time.Hour)},
+	}
+	dnsCacheMutex.Unlock()
+	defer func() { dnsCache = make(map[string]*dnsCacheEntry) }()
+	// the expired entry makes room
+	resolveHost("first.example")
+	if cachedHost("expired.example") || !cachedHost("later.example") || !cachedHost("first.example") {
+		t.Error("should have evicted the expired entry")
+	}
+	// then the one expiring soonest goes
+	resolveHost("second.example")
+	if len(dnsCache) != 2 || cachedHost("first.example") || !cachedHost("second.example") {
+		t.Errorf("should have evicted the entry closest to expiring. Cache size: %d", len(dnsCache))
+	}
+}
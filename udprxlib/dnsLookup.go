@@ -0,0 +1,119 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ttlRecorder keeps the lowest TTL of the address records in the DNS answers it sees
+type ttlRecorder struct {
+	mutex sync.Mutex
+	ttl   uint32
+	found bool
+}
+
+// record parses a DNS answer and keeps the lowest TTL of its A, AAAA and CNAME records
+func (r *ttlRecorder) record(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		switch h.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+			if !r.found || h.TTL < r.ttl {
+				r.ttl = h.TTL
+				r.found = true
+			}
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// ttlConn is a UDP connection to a DNS server that records the TTLs of the answers
+// read from it. It's still a net.PacketConn, so the resolver reads whole messages
+type ttlConn struct {
+	*net.UDPConn
+	recorder *ttlRecorder
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil {
+		c.recorder.record(b[:n])
+	}
+	return n, err
+}
+
+// lookupIPTTL looks a hostname up with Go's resolver, returning its addresses and the
+// lowest TTL of the records they came from. The TTL is 0 when it isn't known, for
+// hostnames from the hosts file or answers that came over TCP
+func lookupIPTTL(host string) ([]net.IP, time.Duration, error) {
+	recorder := &ttlRecorder{}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if udpconn, ok := conn.(*net.UDPConn); ok {
+				return &ttlConn{UDPConn: udpconn, recorder: recorder}, nil
+			}
+			return conn, nil
+		},
+	}
+	addrs, err := resolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if !recorder.found {
+		return ips, 0, nil
+	}
+	// a TTL of 0 still gets the answer used for the packets waiting on it
+	if recorder.ttl == 0 {
+		return ips, time.Second, nil
+	}
+	return ips, time.Duration(recorder.ttl) * time.Second, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTTLRecorder(t *testing.T) {
+	name := dnsmessage.MustNewName("controller1.example.")
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	builder.StartAnswers()
+	for _, ttl := range []uint32{300, 30} {
+		header := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+		builder.AResource(header, dnsmessage.AResource{A: [4]byte{192, 168, 1, 10}})
+	}
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &ttlRecorder{}
+	recorder.record(msg)
+	if !recorder.found || recorder.ttl != 30 {
+		t.Errorf("should have kept the lowest TTL. Got %d", recorder.ttl)
+	}
+	// garbage doesn't count as an answer
+	recorder = &ttlRecorder{}
+	recorder.record([]byte{1, 2, 3})
+	if recorder.found {
+		t.Error("shouldn't have found a TTL in a bad message")
+	}
+}
+
+func TestLookupIPTTLHosts(t *testing.T) {
+	// localhost comes from the hosts file, which has no TTL
+	ips, ttl, err := lookupIPTTL("localhost")
+	if err != nil {
+		t.Skip("localhost doesn't resolve here: ", err)
+	}
+	if len(ips) == 0 || ttl != time.Duration(0) {
+		t.Errorf("wrong result for localhost. IPs: %v, TTL: %s", ips, ttl)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	dtlsnet "github.com/pion/dtls/v3/pkg/net"
+	"github.com/pion/dtls/v3/pkg/protocol"
+	"github.com/pion/dtls/v3/pkg/protocol/recordlayer"
+	"github.com/pion/transport/v3/udp"
+	log "github.com/sirupsen/logrus"
+)
+
+// dtlsMaxWrite is the largest write to a DTLS link. Every write is a single datagram,
+// which the peer has to read into an 8192 byte buffer along with the record overhead
+const dtlsMaxWrite = 8000
+
+// dtlsMaxDatagram is the largest datagram that fits in a DTLS write once it's framed,
+// with room for a sequence number and a multicast group and source. Frames aren't split
+// across datagrams, so maxDatagramSize has to be at most this when DTLS is used
+const dtlsMaxDatagram = dtlsMaxWrite - frameHeaderLen - 8 - 2*(1+net.IPv6len)
+
+// usesDTLS returns true if a config accepts DTLS links or dials any peer over DTLS
+func usesDTLS(conf ConfFile) bool {
+	if conf.DTLS {
+		return true
+	}
+	for _, peer := range conf.Peers {
+		if peer.Transport == TransportDTLS {
+			return true
+		}
+	}
+	return false
+}
+
+// dtlsHandshakeTimeout is how long a DTLS handshake can take, since lost handshake
+// datagrams are retried rather than failing the connection
+var dtlsHandshakeTimeout = 10 * time.Second
+
+// dtlsTransport carries links over DTLS 1.2 on UDP, so a lost datagram only loses
+// itself instead of stalling everything behind it
+type dtlsTransport struct{}
+
+// dtlsLink is a DTLS connection
+type dtlsLink struct {
+	*dtls.Conn
+	reader *bufio.Reader
+}
+
+func newDTLSLink(conn *dtls.Conn) *dtlsLink {
+	// a datagram has to fit in the buffer in one read, and holds whole frames
+	return &dtlsLink{Conn: conn, reader: bufio.NewReaderSize(conn, 0x10000)}
+}
+
+func (l *dtlsLink) Protocol() string {
+	state, ok := l.ConnectionState()
+	if !ok {
+		return ""
+	}
+	return state.NegotiatedProtocol
+}
+
+func (l *dtlsLink) Reader() io.Reader {
+	return l.reader
+}
+
+func (l *dtlsLink) MaxWrite() int {
+	return dtlsMaxWrite
+}
+
+func (l *dtlsLink) PeerFingerprint() string {
+	state, ok := l.ConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return certFingerprint(state.PeerCertificates[0])
+}
+
+// dtlsHandshake completes the handshake on a new DTLS connection, closing it if the
+// handshake fails
+func dtlsHandshake(conn *dtls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	defer cancel()
+	err := conn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+// dtlsClientConfig converts a TLS client config into a DTLS one for dialing host
+func dtlsClientConfig(conf *tls.Config, host string) *dtls.Config {
+	serverName := conf.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &dtls.Config{
+		Certificates:          conf.Certificates,
+		RootCAs:               conf.RootCAs,
+		ServerName:            serverName,
+		InsecureSkipVerify:    conf.InsecureSkipVerify,
+		VerifyPeerCertificate: conf.VerifyPeerCertificate,
+		SupportedProtocols:    conf.NextProtos,
+		ExtendedMasterSecret:  dtls.RequireExtendedMasterSecret,
+	}
+}
+
+// dtlsServerConfig converts a TLS server config into a DTLS one for a client at
+// conn. The config from GetConfigForClient is used if there is one, so DTLS clients
+// are checked by the same rules as TLS clients
+func dtlsServerConfig(conf *tls.Config, conn net.Conn) (*dtls.Config, error) {
+	hello := &tls.ClientHelloInfo{Conn: conn}
+	if conf.GetConfigForClient != nil {
+		clientConf, err := conf.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		if clientConf != nil {
+			conf = clientConf
+		}
+	}
+	certificates := conf.Certificates
+	if conf.GetCertificate != nil {
+		cert, err := conf.GetCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+		certificates = []tls.Certificate{*cert}
+	}
+	return &dtls.Config{
+		Certificates: certificates,
+		// the client auth types are in the same order as crypto/tls's
+		ClientAuth:            dtls.ClientAuthType(conf.ClientAuth),
+		ClientCAs:             conf.ClientCAs,
+		VerifyPeerCertificate: conf.VerifyPeerCertificate,
+		SupportedProtocols:    conf.NextProtos,
+		ExtendedMasterSecret:  dtls.RequireExtendedMasterSecret,
+	}, nil
+}
+
+func (dtlsTransport) Dial(address string, localIP net.IP, conf *tls.Config) (Link, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	var laddr *net.UDPAddr
+	if len(localIP) > 0 {
+		laddr = &net.UDPAddr{IP: localIP}
+	}
+	udpconn, err := net.DialUDP("udp", laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dtls.Client(dtlsnet.PacketConnFromConn(udpconn), raddr, dtlsClientConfig(conf, raddr.IP.String()))
+	if err != nil {
+		udpconn.Close()
+		return nil, err
+	}
+	err = dtlsHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	return newDTLSLink(conn), nil
+}
+
+func (dtlsTransport) Listen(address string, conf *tls.Config) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	lc := udp.ListenConfig{
+		// only a handshake can start a new connection
+		AcceptFilter: func(packet []byte) bool {
+			pkts, err := recordlayer.UnpackDatagram(packet)
+			if err != nil || len(pkts) < 1 {
+				return false
+			}
+			h := &recordlayer.Header{}
+			if err := h.Unmarshal(pkts[0]); err != nil {
+				return false
+			}
+			return h.ContentType == protocol.ContentTypeHandshake
+		},
+	}
+	parent, err := lc.Listen("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	ln := &dtlsListener{
+		parent: parent,
+		conf:   conf,
+		links:  make(chan net.Conn),
+		done:   make(chan bool),
+	}
+	go ln.acceptLoop()
+	return ln, nil
+}
+
+// dtlsListener accepts DTLS links, handshaking with each client in its own go
+// routine so a slow client can't hold up the others
+type dtlsListener struct {
+	parent net.Listener
+	conf   *tls.Config
+	links  chan net.Conn
+	done   chan bool
+	err    error
+}
+
+func (ln *dtlsListener) acceptLoop() {
+	for {
+		conn, err := ln.parent.Accept()
+		if err != nil {
+			ln.err = err
+			close(ln.done)
+			return
+		}
+		go ln.handshake(conn)
+	}
+}
+
+func (ln *dtlsListener) handshake(conn net.Conn) {
+	conf, err := dtlsServerConfig(ln.conf, conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	dconn, err := dtls.Server(dtlsnet.PacketConnFromConn(conn), conn.RemoteAddr(), conf)
+	if err == nil {
+		err = dtlsHandshake(dconn)
+	}
+	if err != nil {
+		incCounter("dtls_handshake_failed")
+		log.WithFields(
+			log.Fields{
+				"error":  err,
+				"remote": conn.RemoteAddr().String(),
+			}).Error("DTLS handshake failed")
+		conn.Close()
+		return
+	}
+	select {
+	case ln.links <- newDTLSLink(dconn):
+	case <-ln.done:
+		dconn.Close()
+	}
+}
+
+func (ln *dtlsListener) Accept() (net.Conn, error) {
+	select {
+	case link := <-ln.links:
+		return link, nil
+	case <-ln.done:
+		return nil, ln.err
+	}
+}
+
+func (ln *dtlsListener) Close() error {
+	return ln.parent.Close()
+}
+
+func (ln *dtlsListener) Addr() net.Addr {
+	return ln.parent.Addr()
+}
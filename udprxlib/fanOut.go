@@ -0,0 +1,191 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// destinationGroups is a map of group names to the IP addresses and hostnames in the
+// group, set by ApplyConfig
+var destinationGroups map[string][]string
+
+// fanOutDestinations returns every destination of a fan-out header, without duplicates
+func fanOutDestinations(header UDPRxHeader) ([]string, error) {
+	var dests []string
+	if header.DestHostname != "" {
+		dests = append(dests, header.DestHostname)
+	} else if header.DestIPAddr != nil {
+		dests = append(dests, header.DestIPAddr.String())
+	}
+	for _, ip := range header.Extensions.Destinations {
+		dests = append(dests, ip.String())
+	}
+	if header.Extensions.DestinationGroup != "" {
+		group, ok := destinationGroups[header.Extensions.DestinationGroup]
+		if !ok {
+			return nil, fmt.Errorf("unknown destination group %q", header.Extensions.DestinationGroup)
+		}
+		dests = append(dests, group...)
+	}
+	seen := make(map[string]bool)
+	unique := dests[:0]
+	for _, dest := range dests {
+		if !seen[dest] {
+			seen[dest] = true
+			unique = append(unique, dest)
+		}
+	}
+	return unique, nil
+}
+
+// configuredDestination returns true if dest is configured as a peer or in a
+// destination group. Only those get counters of their own, since the rest come from
+// headers and there could be any number of them
+func configuredDestination(dest string) bool {
+	for _, peer := range peerConfs {
+		if peer.Address == dest {
+			return true
+		}
+	}
+	for _, group := range destinationGroups {
+		for _, member := range group {
+			if member == dest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countFanOut counts the result of sending to one destination of a fan-out
+func countFanOut(result string, dest string) {
+	configured := configuredDestination(dest)
+	incCounter("fanout_" + result)
+	if configured {
+		incCounter("fanout_" + result + ":" + dest)
+	}
+}
+
+// fanOutPacket sends a packet to every destination of a fan-out header and counts the
+// successes and failures as they're known. Packets for peers are queued without waiting
+// for them to be sent, so each peer's packets stay in ingress order. Hostname
+// destinations that aren't cached are looked up in the background first
+func fanOutPacket(clientConf *tls.Config, header UDPRxHeader, data []byte, srcIP net.IP, srcport int) {
+	dests, err := fanOutDestinations(header)
+	if err != nil {
+		incCounter("fanout_unknown_group")
+		log.WithFields(
+			log.Fields{
+				"error": err,
+			}).Error("Error getting fan-out destinations")
+		return
+	}
+	if header.PortNumber == 0 || header.PortNumber == 1023 {
+		log.WithFields(
+			log.Fields{
+				"dest port": header.PortNumber,
+			}).Error("Got a bad dest port")
+		return
+	}
+	for _, dest := range dests {
+		peerhdr := fanOutHeader(header, dest)
+		if peerhdr.DestHostname != "" {
+			whenResolved(peerhdr.DestHostname, func() {
+				fanOutTo(clientConf, peerhdr, dest, data, srcIP, srcport)
+			})
+			continue
+		}
+		fanOutTo(clientConf, peerhdr, dest, data, srcIP, srcport)
+	}
+}
+
+// fanOutTo sends a fan-out packet to one of its destinations
+func fanOutTo(clientConf *tls.Config, header UDPRxHeader, dest string, data []byte, srcIP net.IP, srcport int) {
+	done := fanOutDone(dest)
+	err := queueToDestination(clientConf, header, data, srcIP, srcport, done)
+	if err != nil {
+		done(err)
+	}
+}
+
+// fanOutDone returns a function that counts and logs the result of sending a fan-out
+// packet to dest
+func fanOutDone(dest string) func(error) {
+	return func(err error) {
+		if err != nil {
+			countFanOut("failed", dest)
+			log.WithFields(
+				log.Fields{
+					"error": err,
+					"dest":  dest,
+				}).Error("Error fanning out packet")
+			return
+		}
+		countFanOut("sent", dest)
+	}
+}
+
+// fanOutHeader returns a copy of a fan-out header addressed to just one of its
+// destinations
+func fanOutHeader(header UDPRxHeader, dest string) UDPRxHeader {
+	peerhdr := peerHeader(header, dest)
+	peerhdr.Extensions.Destinations = nil
+	peerhdr.Extensions.DestinationGroup = ""
+	return peerhdr
+}
+
+// queueToDestination sends a packet to a single unicast destination without waiting
+// for it to be forwarded. Local destinations get the packet directly, anything else is
+// queued for the peer. If done isn't nil it's called with the result once it's known,
+// unless an error is returned
+func queueToDestination(clientConf *tls.Config, header UDPRxHeader, data []byte, srcIP net.IP, srcport int, done func(error)) error {
+	if header.DestHostname != "" {
+		err := resolveHeader(&header)
+		if err != nil {
+			return err
+		}
+	}
+	if header.DestIPAddr.IsMulticast() {
+		return errors.New("fan-out destinations can't be multicast")
+	}
+	isLocalHost, err := isLocalIP(header.DestIPAddr)
+	if err != nil {
+		return err
+	}
+	if isLocalHost {
+		err = SendUDP(srcIP.String(), header.DestIPAddr.String(), uint(srcport), uint(header.PortNumber), data, 0)
+		if err != nil {
+			return err
+		}
+		if done != nil {
+			done(nil)
+		}
+		return nil
+	}
+	// go through the peer's queue so the packet stays in order with the peer's other traffic
+	enqueuePacket(clientConf, header, data, srcport, remotePortFor(header), done)
+	return nil
+}
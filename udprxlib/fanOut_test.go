@@ -0,0 +1,144 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFanOutDestinations(t *testing.T) {
+	destinationGroups = map[string][]string{
+		"controllers": {"192.168.1.100", "192.168.1.102"},
+	}
+	defer func() { destinationGroups = nil }()
+	header := UDPRxHeader{
+		MajorVersion: 2,
+		PortNumber:   50300,
+		DestIPAddr:   net.ParseIP("192.168.1.100"),
+		Extensions: HeaderExtensions{
+			Destinations:     []net.IP{net.ParseIP("192.168.1.101")},
+			DestinationGroup: "controllers",
+		},
+	}
+	dests, err := fanOutDestinations(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(dests)
+	if len(dests) != 3 || dests[0] != "192.168.1.100" || dests[1] != "192.168.1.101" || dests[2] != "192.168.1.102" {
+		t.Errorf("wrong destinations. Got %v", dests)
+	}
+	header.Extensions.DestinationGroup = "missing"
+	_, err = fanOutDestinations(header)
+	if err == nil {
+		t.Error("should have failed with an unknown group")
+	}
+}
+
+func TestFanOutPacket(t *testing.T) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var dests []string
+	wg.Add(2)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		defer wg.Done()
+		mutex.Lock()
+		dests = append(dests, header.DestIPAddr.String())
+		mutex.Unlock()
+		if header.Extensions.isFanOut() {
+			t.Error("forwarded header should only have one destination")
+		}
+		if header.DestIPAddr.String() == "192.168.1.201" {
+			return errors.New("connection failed")
+		}
+		return nil
+	}
+	defer func() { forwardPacketFunc = forwardPacket }()
+	header := UDPRxHeader{
+		MajorVersion: 2,
+		PortNumber:   50300,
+		Extensions: HeaderExtensions{
+			Destinations: []net.IP{net.ParseIP("192.168.1.200"), net.ParseIP("192.168.1.201")},
+		},
+	}
+	// only configured destinations get counters of their own
+	destinationGroups = map[string][]string{"controllers": {"192.168.1.200"}}
+	defer func() { destinationGroups = nil }()
+	before := GetCounters()
+	dispatchPacket(&tls.Config{}, header, []byte{1, 2, 3}, net.IPv4(192, 168, 1, 2), 4000)
+	wg.Wait()
+	sort.Strings(dests)
+	if len(dests) != 2 || dests[0] != "192.168.1.200" || dests[1] != "192.168.1.201" {
+		t.Errorf("packet should have gone to both destinations. Got %v", dests)
+	}
+	// the counters are updated after the forward returns, so wait for them
+	for i := 0; i < 100; i++ {
+		after := GetCounters()
+		if after["fanout_sent:192.168.1.200"] == before["fanout_sent:192.168.1.200"]+1 &&
+			after["fanout_failed"] == before["fanout_failed"]+1 {
+			if _, ok := after["fanout_failed:192.168.1.201"]; ok {
+				t.Error("unconfigured destination shouldn't have a counter")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("fan-out counters weren't updated")
+}
+
+func TestFanOutOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	received := make(map[string][]byte)
+	wg.Add(40)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		defer wg.Done()
+		mutex.Lock()
+		received[header.DestIPAddr.String()] = append(received[header.DestIPAddr.String()], data[0])
+		mutex.Unlock()
+		return nil
+	}
+	defer func() { forwardPacketFunc = forwardPacket }()
+	header := UDPRxHeader{
+		MajorVersion: 2,
+		PortNumber:   50301,
+		Extensions: HeaderExtensions{
+			Destinations: []net.IP{net.ParseIP("192.168.1.210"), net.ParseIP("192.168.1.211")},
+		},
+	}
+	// consecutive packets to the same peer are queued in the order they arrived
+	for i := byte(0); i < 20; i++ {
+		dispatchPacket(&tls.Config{}, header, []byte{i}, net.IPv4(192, 168, 1, 2), 4000)
+	}
+	wg.Wait()
+	for _, dest := range []string{"192.168.1.210", "192.168.1.211"} {
+		for i, b := range received[dest] {
+			if b != byte(i) {
+				t.Fatalf("packets to %s arrived out of order. Got %v", dest, received[dest])
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// header magic numbers
+const (
+	headerStart          = 0x75
+	headerEnd            = 0x80
+	headerSrcIPFollows   = 0x76
+	headerExtensionsNext = 0x77
+)
+
+// address types other than the IP versions. addrTypeNone means the destinations are
+// carried in extension fields instead
+const (
+	addrTypeNone     = 0x00
+	addrTypeHostname = 0x03
+)
+
+// extension field types. The upper bit of the type byte marks a field as critical,
+// meaning a receiver that doesn't understand it must reject the header
+const (
+	extCriticalFlag   = 0x80
+	extTypeFlowID     = 0x01
+	extTypePriority   = 0x02
+	extTypeMaxAge     = 0x03
+	extTypeSourcePort = 0x04
+	extTypeDestList   = 0x05
+	extTypeDestGroup  = 0x06
+)
+
+// HeaderExtensions holds the decoded extension fields of a 2.x header.
+// A zero value for a field means it was not present in the header
+type HeaderExtensions struct {
+	// FlowID is an application defined identifier for the flow this packet belongs to
+	FlowID uint32
+	// Priority is the sender requested priority, higher is more important
+	Priority byte
+	// MaxAge is how long the packet is useful for after it was received
+	MaxAge time.Duration
+	// SourcePort overrides the source port of the local sender
+	SourcePort int
+	// Destinations are extra IP addresses the packet is fanned out to
+	Destinations []net.IP
+	// DestinationGroup is the name of a configured group of destinations to fan out to
+	DestinationGroup string
+}
+
+// isFanOut returns true if the packet is sent to more than the header's destination
+func (ext *HeaderExtensions) isFanOut() bool {
+	return len(ext.Destinations) > 0 || ext.DestinationGroup != ""
+}
+
+// parseHeaderV2 parses a 2.x header. The layout matches 1.0.0 up to the end of the
+// addresses, after which a block of type-length-value extension fields may follow
+func parseHeaderV2(buf *[]byte) (UDPRxHeader, error) {
+	header := UDPRxHeader{}
+	b := *buf
+	if len(b) < 7 {
+		return UDPRxHeader{}, errors.New("header too short")
+	}
+	if b[0] != headerStart {
+		return UDPRxHeader{}, errors.New("Invalid header magic number")
+	}
+	header.MajorVersion = b[1]
+	header.MinorVersion = b[2]
+	header.PatchVersion = b[3]
+	header.PortNumber = (int(b[4]) << 8) + int(b[5])
+	// destination address
+	addrtype := int(b[6])
+	index := 7
+	if addrtype == addrTypeHostname {
+		// a length prefixed DNS name, resolved later by the listener
+		if len(b) < index+1 {
+			return UDPRxHeader{}, errors.New("header too short")
+		}
+		namelen := int(b[index])
+		if namelen == 0 {
+			return UDPRxHeader{}, errors.New("empty destination hostname")
+		}
+		if len(b) < index+1+namelen+1 {
+			return UDPRxHeader{}, errors.New("header too short")
+		}
+		header.DestHostname = string(b[index+1 : index+1+namelen])
+		index += namelen + 1
+	} else if addrtype == addrTypeNone {
+		// the destinations follow in the extension fields
+		if len(b) < index+1 {
+			return UDPRxHeader{}, errors.New("header too short")
+		}
+	} else {
+		iplen, err := ipLength(addrtype)
+		if err != nil {
+			return UDPRxHeader{}, err
+		}
+		if len(b) < index+iplen+1 {
+			return UDPRxHeader{}, errors.New("header too short")
+		}
+		header.DestIPAddr = b[index : index+iplen]
+		index += iplen
+	}
+	// optional source ip address
+	if b[index] == headerSrcIPFollows {
+		index++
+		srctype := addrtype
+		// a hostname doesn't tell us the address family, so it's sent explicitly
+		if addrtype == addrTypeHostname || addrtype == addrTypeNone {
+			if len(b) < index+1 {
+				return UDPRxHeader{}, errors.New("header too short")
+			}
+			srctype = int(b[index])
+			index++
+		}
+		iplen, err := ipLength(srctype)
+		if err != nil {
+			return UDPRxHeader{}, err
+		}
+		if len(b) < index+iplen+1 {
+			return UDPRxHeader{}, errors.New("header too short")
+		}
+		header.SourceIPAddr = b[index : index+iplen]
+		index += iplen
+	}
+	if addrtype != addrTypeHostname && addrtype != addrTypeNone && !checkValidIP(header, addrtype) {
+		return UDPRxHeader{}, errors.New("Invalid destination IP")
+	}
+	// optional extension fields
+	if b[index] == headerExtensionsNext {
+		n, err := parseExtensions(b[index+1:], &header.Extensions)
+		if err != nil {
+			return UDPRxHeader{}, err
+		}
+		index += n + 1
+		if len(b) < index+1 {
+			return UDPRxHeader{}, errors.New("header too short")
+		}
+	}
+	if b[index] != headerEnd {
+		return UDPRxHeader{}, errors.New("Invalid header format")
+	}
+	if addrtype == addrTypeNone && !header.Extensions.isFanOut() {
+		return UDPRxHeader{}, errors.New("header has no destination")
+	}
+	*buf = b[index+1:]
+	return header, nil
+}
+
+// parseExtensions decodes a count prefixed list of extension fields into ext and
+// returns the number of bytes consumed. Unknown optional fields are skipped
+func parseExtensions(b []byte, ext *HeaderExtensions) (int, error) {
+	if len(b) < 1 {
+		return 0, errors.New("header too short")
+	}
+	count := int(b[0])
+	index := 1
+	for i := 0; i < count; i++ {
+		if len(b) < index+2 {
+			return 0, errors.New("header too short")
+		}
+		fieldType := b[index]
+		fieldLen := int(b[index+1])
+		index += 2
+		if len(b) < index+fieldLen {
+			return 0, errors.New("header too short")
+		}
+		value := b[index : index+fieldLen]
+		index += fieldLen
+		known, err := decodeExtension(fieldType&^extCriticalFlag, value, ext)
+		if err != nil {
+			return 0, err
+		}
+		if !known && fieldType&extCriticalFlag != 0 {
+			return 0, fmt.Errorf("unsupported critical extension field 0x%02x", fieldType)
+		}
+	}
+	return index, nil
+}
+
+// decodeExtension sets the field in ext for a single extension. It returns false
+// if the field type isn't one we know about
+func decodeExtension(fieldType byte, value []byte, ext *HeaderExtensions) (bool, error) {
+	switch fieldType {
+	case extTypeFlowID:
+		if len(value) != 4 {
+			return true, errors.New("invalid flow id length")
+		}
+		ext.FlowID = uint32(value[0])<<24 | uint32(value[1])<<16 | uint32(value[2])<<8 | uint32(value[3])
+	case extTypePriority:
+		if len(value) != 1 {
+			return true, errors.New("invalid priority length")
+		}
+		ext.Priority = value[0]
+	case extTypeMaxAge:
+		if len(value) != 2 {
+			return true, errors.New("invalid max age length")
+		}
+		ext.MaxAge = time.Duration((int(value[0])<<8)+int(value[1])) * time.Millisecond
+	case extTypeSourcePort:
+		if len(value) != 2 {
+			return true, errors.New("invalid source port length")
+		}
+		ext.SourcePort = (int(value[0]) << 8) + int(value[1])
+	case extTypeDestList:
+		// a list of IP version bytes, each followed by an address
+		for i := 0; i < len(value); {
+			iplen, err := ipLength(int(value[i]))
+			if err != nil {
+				return true, err
+			}
+			if len(value) < i+1+iplen {
+				return true, errors.New("invalid destination list length")
+			}
+			ext.Destinations = append(ext.Destinations, net.IP(value[i+1:i+1+iplen]))
+			i += iplen + 1
+		}
+	case extTypeDestGroup:
+		if len(value) == 0 {
+			return true, errors.New("empty destination group")
+		}
+		ext.DestinationGroup = string(value)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// ipLength returns the length of an address for an IP version byte
+func ipLength(ipversion int) (int, error) {
+	if ipversion == 4 {
+		return 4, nil
+	} else if ipversion == 6 {
+		return 16, nil
+	}
+	return 0, errors.New("unsupported IP version")
+}
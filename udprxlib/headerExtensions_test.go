@@ -0,0 +1,200 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+package udprxlib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHeaderV2NoExtensions(t *testing.T) {
+	// 2.0.0 to 192.168.1.100:50300, no extensions, followed by 2 bytes of data
+	buf := []byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 100, 0x80, 5, 4}
+	header, err := parseHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.MajorVersion != 2 {
+		t.Error("wrong major version")
+	}
+	if header.PortNumber != 50300 {
+		t.Error("Wrong Port Number")
+	}
+	if header.DestIPAddr.String() != "192.168.1.100" {
+		t.Errorf("Wrong Dest IP. Got %s", header.DestIPAddr.String())
+	}
+	if len(buf) != 2 || buf[0] != 5 || buf[1] != 4 {
+		t.Errorf("header not removed from buffer. Got %v", buf)
+	}
+}
+
+func TestParseHeaderV2Extensions(t *testing.T) {
+	buf := []byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 100,
+		// source ip 192.168.1.102
+		0x76, 192, 168, 1, 102,
+		// 5 extension fields
+		0x77, 0x05,
+		// flow id
+		0x01, 0x04, 0x00, 0x00, 0x01, 0x02,
+		// priority
+		0x02, 0x01, 0x07,
+		// max age of 1500ms
+		0x03, 0x02, 0x05, 0xDC,
+		// an unknown optional field, which should be skipped
+		0x3F, 0x03, 0xAA, 0xBB, 0xCC,
+		// critical source port override of 4499
+		0x84, 0x02, 0x11, 0x93,
+		// end
+		0x80,
+		// data
+		9}
+	header, err := parseHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.SourceIPAddr.String() != "192.168.1.102" {
+		t.Errorf("Wrong Source IP. Got %s", header.SourceIPAddr.String())
+	}
+	if header.Extensions.FlowID != 258 {
+		t.Errorf("Wrong flow id. Got %d", header.Extensions.FlowID)
+	}
+	if header.Extensions.Priority != 7 {
+		t.Errorf("Wrong priority. Got %d", header.Extensions.Priority)
+	}
+	if header.Extensions.MaxAge != 1500*time.Millisecond {
+		t.Errorf("Wrong max age. Got %s", header.Extensions.MaxAge)
+	}
+	if header.Extensions.SourcePort != 4499 {
+		t.Errorf("Wrong source port. Got %d", header.Extensions.SourcePort)
+	}
+	if len(buf) != 1 || buf[0] != 9 {
+		t.Errorf("header not removed from buffer. Got %v", buf)
+	}
+}
+
+func TestParseHeaderV2UnknownCritical(t *testing.T) {
+	buf := []byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 100,
+		0x77, 0x01, 0xBF, 0x01, 0x00, 0x80}
+	_, err := parseHeader(&buf)
+	if err == nil {
+		t.Error("unknown critical extension should have been rejected")
+	}
+}
+
+func TestParseHeaderV2Truncated(t *testing.T) {
+	headers := [][]byte{
+		// ipv4 with a flow id
+		{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 100,
+			0x77, 0x01, 0x01, 0x04, 0x00, 0x00, 0x01, 0x02, 0x80},
+		// ipv6 with a source ip
+		{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x06, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x76, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0x80},
+		// hostname with a source ip
+		{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x03, 3, 'c', 't', 'l', 0x76, 0x04, 192, 168, 1, 102, 0x80},
+		// no destination address, with a destination list
+		{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x00, 0x77, 0x01, 0x85, 0x05, 0x04, 192, 168, 1, 100, 0x80},
+	}
+	for _, full := range headers {
+		for i := 0; i < len(full); i++ {
+			// an exact length buffer, like the listener reads each datagram into
+			buf := make([]byte, i)
+			copy(buf, full)
+			_, err := parseHeader(&buf)
+			if err == nil {
+				t.Errorf("header %v truncated to %d bytes should not parse", full, i)
+			}
+		}
+		buf := make([]byte, len(full))
+		copy(buf, full)
+		if _, err := parseHeader(&buf); err != nil {
+			t.Errorf("header %v should parse. Got %v", full, err)
+		}
+	}
+}
+
+func TestParseHeaderUnsupportedVersion(t *testing.T) {
+	buf := []byte{0x75, 0x03, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 100, 0x80}
+	_, err := parseHeader(&buf)
+	if err == nil {
+		t.Error("major version 3 should not parse")
+	}
+}
+
+func TestParseHeaderV2Hostname(t *testing.T) {
+	buf := []byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x03, 11,
+		'c', 'o', 'n', 't', 'r', 'o', 'l', 'l', 'e', 'r', '1',
+		// ipv4 source ip 192.168.1.102
+		0x76, 0x04, 192, 168, 1, 102,
+		0x80, 7}
+	header, err := parseHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.DestHostname != "controller1" {
+		t.Errorf("Wrong hostname. Got %s", header.DestHostname)
+	}
+	if header.DestIPAddr != nil {
+		t.Error("Dest IP should not be set before resolution")
+	}
+	if header.SourceIPAddr.String() != "192.168.1.102" {
+		t.Errorf("Wrong Source IP. Got %s", header.SourceIPAddr.String())
+	}
+	if len(buf) != 1 || buf[0] != 7 {
+		t.Errorf("header not removed from buffer. Got %v", buf)
+	}
+}
+
+func TestParseHeaderV2FanOut(t *testing.T) {
+	buf := []byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C,
+		// no destination address, they're in the extensions
+		0x00,
+		// 2 extension fields
+		0x77, 0x02,
+		// critical destination list of 192.168.1.100 and 192.168.1.101
+		0x85, 0x0A, 0x04, 192, 168, 1, 100, 0x04, 192, 168, 1, 101,
+		// critical destination group "ctl"
+		0x86, 0x03, 'c', 't', 'l',
+		// end
+		0x80,
+		// data
+		9}
+	header, err := parseHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.DestIPAddr != nil {
+		t.Errorf("should have no destination address. Got %s", header.DestIPAddr.String())
+	}
+	dests := header.Extensions.Destinations
+	if len(dests) != 2 || dests[0].String() != "192.168.1.100" || dests[1].String() != "192.168.1.101" {
+		t.Errorf("Wrong destinations. Got %v", dests)
+	}
+	if header.Extensions.DestinationGroup != "ctl" {
+		t.Errorf("Wrong destination group. Got %s", header.Extensions.DestinationGroup)
+	}
+	if len(buf) != 1 || buf[0] != 9 {
+		t.Errorf("header not removed from buffer. Got %v", buf)
+	}
+	// no destination address and no destination extensions
+	buf = []byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x00, 0x80, 9}
+	_, err = parseHeader(&buf)
+	if err == nil {
+		t.Error("should have failed with no destination")
+	}
+}
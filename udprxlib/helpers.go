@@ -28,7 +28,7 @@ import (
 var getTime = time.Now().UTC().UnixNano
 
 func intToBytes(input int) []byte {
-	// this must be less than 1024 so we only have a few use cases
+	// only the lower 2 bytes are kept, so this must be less than 65536
 	output := make([]byte, 2)
 	lower := input & 0xFF
 	output[1] = byte(lower)
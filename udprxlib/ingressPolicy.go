@@ -0,0 +1,224 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IngressRule allows local senders to use the udp_rx ingress port. A datagram is
+// accepted if it matches any rule
+type IngressRule struct {
+	// SourceCIDRs are the networks the sender's address must be in
+	SourceCIDRs []string `json:"sourceCIDRs"`
+	// SourcePorts are the ports the sender may send from. Empty allows any port
+	SourcePorts []int `json:"sourcePorts"`
+	// Destinations are the "host:port" destinations the sender may reach, where host is an
+	// IP address, CIDR or hostname and port may be "*". Empty allows any destination
+	Destinations []string `json:"destinations"`
+}
+
+// ingressRule is an IngressRule with its addresses parsed
+type ingressRule struct {
+	sources      []*net.IPNet
+	sourcePorts  []int
+	destinations []ingressDest
+}
+
+// ingressDest is a single whitelisted destination. A zero port matches any port
+type ingressDest struct {
+	network  *net.IPNet
+	hostname string
+	port     int
+}
+
+// ingressRules are the parsed ingress rules, set by ApplyConfig. With no rules every
+// sender is accepted
+var ingressRules []ingressRule
+
+// ingressRejectLogInterval is the least amount of time between logs of rejected datagrams
+var ingressRejectLogInterval = 10 * time.Second
+var lastIngressRejectLog time.Time
+var ingressRejectedSinceLog int
+var ingressRejectLogMutex = &sync.Mutex{}
+
+// parseIngressRules parses the ingress rules from the config file
+func parseIngressRules(rules []IngressRule) ([]ingressRule, error) {
+	var parsed []ingressRule
+	for _, rule := range rules {
+		var p ingressRule
+		if len(rule.SourceCIDRs) == 0 {
+			return nil, fmt.Errorf("ingress rule has no source CIDRs")
+		}
+		for _, cidr := range rule.SourceCIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			p.sources = append(p.sources, network)
+		}
+		p.sourcePorts = rule.SourcePorts
+		for _, destination := range rule.Destinations {
+			dest, err := parseIngressDest(destination)
+			if err != nil {
+				return nil, err
+			}
+			p.destinations = append(p.destinations, dest)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// parseIngressDest parses a "host:port" whitelist entry
+func parseIngressDest(destination string) (ingressDest, error) {
+	host, portstr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return ingressDest{}, err
+	}
+	dest := ingressDest{}
+	if portstr != "*" {
+		dest.port, err = strconv.Atoi(portstr)
+		if err != nil || dest.port <= 0 || dest.port > 0xFFFF {
+			return ingressDest{}, fmt.Errorf("invalid ingress destination port %q", portstr)
+		}
+	}
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		dest.network = network
+	} else if ip := net.ParseIP(host); ip != nil {
+		dest.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	} else {
+		dest.hostname = host
+	}
+	return dest, nil
+}
+
+// matches returns true if the whitelist entry allows sending to dest:port. dest is
+// an IP address or a hostname
+func (d ingressDest) matches(dest string, port int) bool {
+	if d.port != 0 && d.port != port {
+		return false
+	}
+	if d.hostname != "" {
+		return d.hostname == dest
+	}
+	ip := net.ParseIP(dest)
+	return ip != nil && d.network.Contains(ip)
+}
+
+// allows returns true if the rule lets the sender reach every one of dests on destport
+func (rule ingressRule) allows(srcIP net.IP, srcport int, dests []string, destport int) bool {
+	sourceOK := false
+	for _, network := range rule.sources {
+		if network.Contains(srcIP) {
+			sourceOK = true
+			break
+		}
+	}
+	if !sourceOK {
+		return false
+	}
+	if len(rule.sourcePorts) != 0 {
+		portOK := false
+		for _, port := range rule.sourcePorts {
+			if port == srcport {
+				portOK = true
+				break
+			}
+		}
+		if !portOK {
+			return false
+		}
+	}
+	if len(rule.destinations) == 0 {
+		return true
+	}
+	for _, dest := range dests {
+		destOK := false
+		for _, allowed := range rule.destinations {
+			if allowed.matches(dest, destport) {
+				destOK = true
+				break
+			}
+		}
+		if !destOK {
+			return false
+		}
+	}
+	return true
+}
+
+// ingressAllowed returns true if the ingress rules let a local sender send a packet
+// with the header. Rejected packets are counted and logged
+func ingressAllowed(srcIP net.IP, srcport int, header UDPRxHeader) bool {
+	if len(ingressRules) == 0 {
+		return true
+	}
+	dests, err := headerDestinations(header)
+	if err == nil {
+		for _, rule := range ingressRules {
+			if rule.allows(srcIP, srcport, dests, header.PortNumber) {
+				return true
+			}
+		}
+	}
+	incCounter("ingress_rejected")
+	logIngressRejected(srcIP, srcport, header)
+	return false
+}
+
+// headerDestinations returns the destinations of a header as IP address or hostname strings
+func headerDestinations(header UDPRxHeader) ([]string, error) {
+	if header.Extensions.isFanOut() {
+		return fanOutDestinations(header)
+	}
+	if header.DestHostname != "" {
+		return []string{header.DestHostname}, nil
+	}
+	return []string{header.DestIPAddr.String()}, nil
+}
+
+// logIngressRejected logs a rejected datagram, at most once per ingressRejectLogInterval
+// so a misbehaving sender can't flood the log
+func logIngressRejected(srcIP net.IP, srcport int, header UDPRxHeader) {
+	ingressRejectLogMutex.Lock()
+	defer ingressRejectLogMutex.Unlock()
+	ingressRejectedSinceLog++
+	if time.Since(lastIngressRejectLog) < ingressRejectLogInterval {
+		return
+	}
+	log.WithFields(
+		log.Fields{
+			"srcip":    srcIP.String(),
+			"srcport":  srcport,
+			"dest":     header.DestIPAddr.String(),
+			"desthost": header.DestHostname,
+			"destport": header.PortNumber,
+			"rejected": ingressRejectedSinceLog,
+		}).Warn("Datagram rejected by ingress policy")
+	lastIngressRejectLog = time.Now()
+	ingressRejectedSinceLog = 0
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIngressAllowed(t *testing.T) {
+	rules, err := parseIngressRules([]IngressRule{
+		// the app server can only reach the controllers on 50300
+		{SourceCIDRs: []string{"192.168.1.10/32"}, Destinations: []string{"10.1.0.0/16:50300", "ctl.site.local:*"}},
+		// the local subnet can send anywhere from port 4000
+		{SourceCIDRs: []string{"192.168.2.0/24"}, SourcePorts: []int{4000}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingressRules = rules
+	defer func() { ingressRules = nil }()
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("10.1.2.3")}
+	if !ingressAllowed(net.ParseIP("192.168.1.10"), 5000, header) {
+		t.Error("whitelisted destination should be allowed")
+	}
+	if ingressAllowed(net.ParseIP("192.168.1.11"), 5000, header) {
+		t.Error("sender outside the source CIDRs should be rejected")
+	}
+	if !ingressAllowed(net.ParseIP("192.168.2.40"), 4000, header) {
+		t.Error("sender from an allowed port should be allowed")
+	}
+	if ingressAllowed(net.ParseIP("192.168.2.40"), 4001, header) {
+		t.Error("sender from a port that isn't allowed should be rejected")
+	}
+	header.PortNumber = 50301
+	if ingressAllowed(net.ParseIP("192.168.1.10"), 5000, header) {
+		t.Error("destination port that isn't whitelisted should be rejected")
+	}
+	header = UDPRxHeader{MajorVersion: 2, PortNumber: 7000, DestHostname: "ctl.site.local"}
+	if !ingressAllowed(net.ParseIP("192.168.1.10"), 5000, header) {
+		t.Error("whitelisted hostname should be allowed on any port")
+	}
+	// every fan-out destination has to be whitelisted
+	header = UDPRxHeader{MajorVersion: 2, PortNumber: 50300, Extensions: HeaderExtensions{
+		Destinations: []net.IP{net.ParseIP("10.1.2.3"), net.ParseIP("10.2.2.3")},
+	}}
+	if ingressAllowed(net.ParseIP("192.168.1.10"), 5000, header) {
+		t.Error("fan-out to a destination that isn't whitelisted should be rejected")
+	}
+	if GetCounters()["ingress_rejected"] == 0 {
+		t.Error("rejected datagrams should be counted")
+	}
+}
+
+func TestIngressNoRules(t *testing.T) {
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("10.1.2.3")}
+	if !ingressAllowed(net.ParseIP("172.16.0.1"), 5000, header) {
+		t.Error("with no rules every sender should be allowed")
+	}
+}
+
+func TestParseIngressRulesInvalid(t *testing.T) {
+	invalid := [][]IngressRule{
+		{{}},
+		{{SourceCIDRs: []string{"192.168.1.10"}}},
+		{{SourceCIDRs: []string{"192.168.1.0/24"}, Destinations: []string{"10.1.2.3"}}},
+		{{SourceCIDRs: []string{"192.168.1.0/24"}, Destinations: []string{"10.1.2.3:70000"}}},
+	}
+	for _, rules := range invalid {
+		_, err := parseIngressRules(rules)
+		if err == nil {
+			t.Errorf("should have failed to parse %v", rules)
+		}
+	}
+}
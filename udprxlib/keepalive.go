@@ -0,0 +1,129 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// KeepaliveInterval is how often a ping is sent on links that speak typed frames
+var KeepaliveInterval = 15 * time.Second
+
+// KeepaliveTimeout is how long a link that speaks typed frames can go without
+// receiving anything before it's considered dead and evicted
+var KeepaliveTimeout = 45 * time.Second
+
+// alwaysUpCheckInterval is how often always up peers are checked for a connection.
+// Re-dials are still limited by the peer's backoff
+var alwaysUpCheckInterval = time.Second
+
+// keepalive pings the peer on conn every KeepaliveInterval until stop is closed. The
+// ping body is the send time, which the pong echoes back
+func keepalive(conn net.Conn, stop chan bool) {
+	ticker := time.NewTicker(KeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			body := make([]byte, 8)
+			copy(body, getTimeBytes())
+			conn.SetWriteDeadline(time.Now().Add(KeepaliveTimeout))
+			_, err := conn.Write(encodeFrame(frameTypePing, 0, body))
+			conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				log.WithFields(
+					log.Fields{
+						"error":  err,
+						"remote": conn.RemoteAddr().String(),
+					}).Error("Error sending keepalive")
+				return
+			}
+		}
+	}
+}
+
+// isTimeout returns true if err is a read or write deadline expiring
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// maintainingPeers is a map of the addresses of always up peers being dialed to true
+var maintainingPeers = sync.Map{}
+
+// MaintainPeers keeps a connection open to every peer marked always up, re-dialing
+// in the background when one goes away so the tunnel is ready before traffic arrives.
+// It never returns, so it should be run in its own go routine
+func MaintainPeers(clientConf *tls.Config) {
+	for {
+		maintainPeers(clientConf)
+		time.Sleep(alwaysUpCheckInterval)
+	}
+}
+
+// maintainPeers checks each always up peer in its own go routine, so a peer that's
+// slow to dial doesn't hold up the others. A peer that's still being dialed from the
+// last check is skipped
+func maintainPeers(clientConf *tls.Config) {
+	for _, peer := range peerConfs {
+		if !peer.AlwaysUp {
+			continue
+		}
+		if _, busy := maintainingPeers.LoadOrStore(peer.Address, true); busy {
+			continue
+		}
+		go func(peer PeerConf) {
+			defer maintainingPeers.Delete(peer.Address)
+			maintainPeer(clientConf, peer)
+		}(peer)
+	}
+}
+
+// maintainPeer dials each connection to an always up peer that isn't cached
+func maintainPeer(clientConf *tls.Config, peer PeerConf) {
+	header := peerHeader(UDPRxHeader{MajorVersion: 2}, peer.Address)
+	if header.DestHostname != "" {
+		err := resolveHeader(&header)
+		if err != nil {
+			return
+		}
+	}
+	connections, pinned := peerLanes(header)
+	for lane := 0; lane < connections+len(pinned); lane++ {
+		if _, ok := connMap.Load(connKey(header, lane)); ok {
+			continue
+		}
+		// getLaneConn caches the new connection, and returns a connTimeoutError while a
+		// failed peer is backing off
+		_, err := getLaneConn(header, clientConf, remotePortFor(header), lane)
+		if err == nil {
+			incCounter("always_up_dials")
+			// packets sent while the peer was unreachable can go now
+			go flushPending(header.DestIPAddr.String())
+		}
+	}
+}
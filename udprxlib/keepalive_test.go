@@ -0,0 +1,164 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveTimeout(t *testing.T) {
+	oldTimeout := KeepaliveTimeout
+	KeepaliveTimeout = 50 * time.Millisecond
+	client, server := net.Pipe()
+	before := GetCounters()["keepalive_timeouts"]
+	done := make(chan bool)
+	go func() {
+		handleFrames(server, bufio.NewReader(server), nil)
+		close(done)
+	}()
+	// the timeout is only restored once the link's reader is finished with it
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		<-done
+		KeepaliveTimeout = oldTimeout
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent link should have been evicted")
+	}
+	if GetCounters()["keepalive_timeouts"] != before+1 {
+		t.Error("keepalive timeout wasn't counted")
+	}
+}
+
+func TestKeepalivePing(t *testing.T) {
+	oldInterval := KeepaliveInterval
+	KeepaliveInterval = 10 * time.Millisecond
+	client, server := net.Pipe()
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		keepalive(server, stop)
+		close(done)
+	}()
+	// the interval is only restored once the keepalive has stopped
+	t.Cleanup(func() {
+		close(stop)
+		client.Close()
+		<-done
+		KeepaliveInterval = oldInterval
+	})
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := readFrame(bufio.NewReader(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != frameTypePing || len(frame.Body) != 8 {
+		t.Errorf("expected a ping. Got type %d with %d bytes", frame.Type, len(frame.Body))
+	}
+}
+
+func TestApplyConfigKeepalive(t *testing.T) {
+	oldInterval, oldTimeout := KeepaliveInterval, KeepaliveTimeout
+	defer func() { KeepaliveInterval, KeepaliveTimeout = oldInterval, oldTimeout }()
+	err := ApplyConfig(ConfFile{KeepaliveInterval: 30, KeepaliveTimeout: 20})
+	if err == nil {
+		t.Error("timeout shorter than the interval should be rejected")
+	}
+	KeepaliveInterval, KeepaliveTimeout = oldInterval, oldTimeout
+	err = ApplyConfig(ConfFile{KeepaliveInterval: 5, KeepaliveTimeout: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeepaliveInterval != 5*time.Second || KeepaliveTimeout != 20*time.Second {
+		t.Errorf("wrong keepalive settings. Got %v and %v", KeepaliveInterval, KeepaliveTimeout)
+	}
+}
+
+// stallTransport is a Transport whose dials to 192.168.8.1 hang until release is
+// closed, like a peer behind a black hole. Every dial is reported on dials and fails
+type stallTransport struct {
+	release chan bool
+	dials   chan string
+}
+
+func (s *stallTransport) Dial(address string, localIP net.IP, conf *tls.Config) (Link, error) {
+	s.dials <- address
+	if strings.HasPrefix(address, "192.168.8.1:") {
+		<-s.release
+	}
+	return nil, errors.New("connection refused")
+}
+
+func (s *stallTransport) Listen(address string, conf *tls.Config) (net.Listener, error) {
+	return nil, errors.New("can't listen")
+}
+
+func TestMaintainPeersStalled(t *testing.T) {
+	stall := &stallTransport{release: make(chan bool), dials: make(chan string, 10)}
+	transports["stall"] = stall
+	oldPeers := peerConfs
+	peerConfs = []PeerConf{
+		{Address: "192.168.8.1", AlwaysUp: true, Transport: "stall"},
+		{Address: "192.168.8.2", AlwaysUp: true, Transport: "stall"},
+	}
+	defer func() {
+		close(stall.release)
+		// let the dials finish before putting things back
+		for _, ip := range []string{"192.168.8.1", "192.168.8.2"} {
+			for {
+				if _, busy := maintainingPeers.Load(ip); !busy {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			peerStates.Delete(ip)
+		}
+		delete(transports, "stall")
+		peerConfs = oldPeers
+	}()
+	maintainPeers(&tls.Config{})
+	// the peer that doesn't answer doesn't hold up the other one
+	dialed := make(map[string]bool)
+	for len(dialed) < 2 {
+		select {
+		case address := <-stall.dials:
+			dialed[strings.Split(address, ":")[0]] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("both peers should have been dialed. Got %v", dialed)
+		}
+	}
+	// and it isn't dialed again while its first dial is still going
+	maintainPeers(&tls.Config{})
+	time.Sleep(50 * time.Millisecond)
+	for len(stall.dials) > 0 {
+		if address := <-stall.dials; strings.HasPrefix(address, "192.168.8.1:") {
+			t.Error("stalled peer shouldn't be dialed twice at once")
+		}
+	}
+}
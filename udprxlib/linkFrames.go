@@ -0,0 +1,402 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// linkProtocolV1 is the ALPN protocol for the legacy framing on the TLS link. Peers
+// from before ALPN don't negotiate anything and get the legacy framing too
+const linkProtocolV1 = "udprx/1"
+
+// linkProtocolV2 is the ALPN protocol for typed frames on the TLS link
+const linkProtocolV2 = "udprx/2"
+
+// linkProtocols are the ALPN protocols we offer and accept, highest version first.
+// Both ends prefer the first one they have in common
+var linkProtocols = []string{linkProtocolV2, linkProtocolV1}
+
+// linkVersion returns the link protocol version a negotiated ALPN protocol stands
+// for, or 0 if it isn't one of ours
+func linkVersion(protocol string) int {
+	switch protocol {
+	case "", linkProtocolV1:
+		return 1
+	case linkProtocolV2:
+		return 2
+	}
+	return 0
+}
+
+// commonLinkProtocol returns the highest link protocol that a peer offered and we
+// support. Peers that offer nothing predate ALPN and get the legacy framing, but a
+// peer that only offers versions we don't know can't be spoken to
+func commonLinkProtocol(offered []string) (string, error) {
+	if len(offered) == 0 {
+		return "", nil
+	}
+	for _, protocol := range linkProtocols {
+		for _, peerProtocol := range offered {
+			if protocol == peerProtocol {
+				return protocol, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no common link protocol version, peer offers %v and we support %v", offered, linkProtocols)
+}
+
+// isProtocolMismatch returns true if a handshake failed because the peer doesn't
+// support any of our link protocol versions
+func isProtocolMismatch(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "no application protocol") ||
+		strings.Contains(err.Error(), "unadvertised ALPN protocol"))
+}
+
+// typed frames are version(1), type(1), flags(1), length(2), body
+const (
+	frameVersion   = 2
+	frameHeaderLen = 5
+)
+
+// frame types
+const (
+	// frameTypeData bodies are srcport(2), destport(2), payload, preceded by
+	// sequence(4) if frameFlagSequenced is set. The payload of a multicast frame is
+	// preceded by the group and sender address lengths(1) and addresses
+	frameTypeData = 0x01
+	// frameTypePing bodies are echoed back in a frameTypePong
+	frameTypePing = 0x02
+	frameTypePong = 0x03
+	// frameTypeClose tells the peer the link is going away. It has no body
+	frameTypeClose = 0x04
+	// frameTypeError bodies are code(1), srcport(2), destport(2), message
+	frameTypeError = 0x05
+	// frameTypeSettings is sent by each side when the link opens. Its body is the
+	// compression algorithm IDs the sender can decompress
+	frameTypeSettings = 0x06
+)
+
+// data frame flags
+const (
+	// frameFlagSequenced marks a data frame that carries a flow sequence number
+	frameFlagSequenced = 0x01
+	// frameFlagCompressed marks a data frame whose payload is compressed with the
+	// algorithm negotiated for the link
+	frameFlagCompressed = 0x02
+	// frameFlagMulticast marks a data frame for a multicast group, which the peer
+	// re-emits to the group instead of delivering it locally
+	frameFlagMulticast = 0x04
+)
+
+// error report codes
+const (
+	frameErrPortRefused    = 0x01
+	frameErrDeliveryFailed = 0x02
+	frameErrUnsupported    = 0x03
+	frameErrTooLarge       = 0x04
+)
+
+// linkFrame is a typed frame read from the TLS link
+type linkFrame struct {
+	Version byte
+	Type    byte
+	Flags   byte
+	Body    []byte
+}
+
+// frameErrorText returns a readable name for an error report code
+func frameErrorText(code byte) string {
+	switch code {
+	case frameErrPortRefused:
+		return "destination port refused"
+	case frameErrDeliveryFailed:
+		return "delivery failed"
+	case frameErrUnsupported:
+		return "unsupported frame"
+	case frameErrTooLarge:
+		return "frame too large"
+	}
+	return fmt.Sprintf("unknown error 0x%02x", code)
+}
+
+// linkProtocol returns the link protocol negotiated on a connection, completing the
+// handshake if needed. Connections that aren't TLS or DTLS have no protocol
+func linkProtocol(conn net.Conn) string {
+	return asLink(conn).Protocol()
+}
+
+// encodeFrame builds a typed frame. body must be shorter than 65536 bytes
+func encodeFrame(frameType byte, flags byte, body []byte) []byte {
+	frame := make([]byte, frameHeaderLen+len(body))
+	frame[0] = frameVersion
+	frame[1] = frameType
+	frame[2] = flags
+	copy(frame[3:5], intToBytes(len(body)))
+	copy(frame[frameHeaderLen:], body)
+	return frame
+}
+
+// encodeDataFrame builds a sequenced data frame for a datagram
+func encodeDataFrame(srcprt int, destport int, seq uint32, data []byte) []byte {
+	return encodePayloadFrame(frameFlagSequenced, srcprt, destport, seq, nil, nil, data)
+}
+
+// encodePayloadFrame builds a sequenced data frame with flags for a payload. A
+// non-nil group marks it as a multicast frame for that group, sent by source
+func encodePayloadFrame(flags byte, srcprt int, destport int, seq uint32, group net.IP, source net.IP, payload []byte) []byte {
+	if group != nil {
+		group = shortestIP(group)
+		source = shortestIP(source)
+		flags |= frameFlagMulticast
+	}
+	body := make([]byte, 8, 10+len(group)+len(source)+len(payload))
+	binary.BigEndian.PutUint32(body[0:4], seq)
+	copy(body[4:6], intToBytes(srcprt))
+	copy(body[6:8], intToBytes(destport))
+	if group != nil {
+		body = append(body, byte(len(group)))
+		body = append(body, group...)
+		body = append(body, byte(len(source)))
+		body = append(body, source...)
+	}
+	body = append(body, payload...)
+	return encodeFrame(frameTypeData, flags, body)
+}
+
+// shortestIP returns the 4 byte form of an IPv4 address, so it's sent in as few bytes
+// as possible
+func shortestIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// readFrameIP reads a length prefixed IPv4 or IPv6 address from the start of b and
+// returns it and the rest of b
+func readFrameIP(b []byte) (net.IP, []byte, bool) {
+	if len(b) < 1 || (b[0] != net.IPv4len && b[0] != net.IPv6len) || len(b) < 1+int(b[0]) {
+		return nil, b, false
+	}
+	return net.IP(b[1 : 1+b[0]]), b[1+b[0]:], true
+}
+
+// encodeErrorFrame builds an error report about a datagram from srcport to destport
+func encodeErrorFrame(code byte, srcport uint, destport uint, message string) []byte {
+	body := make([]byte, 5+len(message))
+	body[0] = code
+	copy(body[1:3], intToBytes(int(srcport)))
+	copy(body[3:5], intToBytes(int(destport)))
+	copy(body[5:], message)
+	return encodeFrame(frameTypeError, 0, body)
+}
+
+// readFrame reads one typed frame from r
+func readFrame(r io.Reader) (linkFrame, error) {
+	hdr := make([]byte, frameHeaderLen)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return linkFrame{}, err
+	}
+	frame := linkFrame{Version: hdr[0], Type: hdr[1], Flags: hdr[2]}
+	length := (int(hdr[3]) << 8) + int(hdr[4])
+	frame.Body = make([]byte, length)
+	_, err = io.ReadFull(r, frame.Body)
+	if err != nil {
+		return linkFrame{}, err
+	}
+	return frame, nil
+}
+
+// handleFrames reads typed frames from a peer until the link closes
+func handleFrames(conn net.Conn, r io.Reader, sender sendUDPFn) {
+	counter := 0
+	for {
+		// anything from the peer, including pongs, keeps the link alive
+		conn.SetReadDeadline(time.Now().Add(KeepaliveTimeout))
+		frame, err := readFrame(r)
+		if err != nil {
+			if isTimeout(err) {
+				incCounter("keepalive_timeouts")
+				log.WithFields(
+					log.Fields{
+						"remote":  conn.RemoteAddr().String(),
+						"timeout": KeepaliveTimeout.String(),
+					}).Warn("Peer missed its keepalive deadline, evicting connection")
+			} else if err != io.EOF {
+				log.WithFields(
+					log.Fields{
+						"error": err,
+					}).Error("Error reading frame from TLS connection")
+			}
+			return
+		}
+		if frame.Version != frameVersion {
+			incCounter("frames_malformed")
+			log.WithFields(
+				log.Fields{
+					"version": frame.Version,
+				}).Error("Unsupported frame version, closing connection")
+			return
+		}
+		switch frame.Type {
+		case frameTypeData:
+			handleDataFrame(conn, frame, &counter, sender)
+		case frameTypePing:
+			conn.Write(encodeFrame(frameTypePong, 0, frame.Body))
+		case frameTypePong:
+			// replies to our keepalives, reading it is what keeps the link alive
+		case frameTypeClose:
+			log.WithField("remote", conn.RemoteAddr().String()).Info("Peer closed the link")
+			forgetConn(conn)
+			return
+		case frameTypeError:
+			handleErrorFrame(conn, frame)
+		case frameTypeSettings:
+			handleSettingsFrame(conn, frame)
+		default:
+			incCounter("frames_unsupported")
+			conn.Write(encodeErrorFrame(frameErrUnsupported, 0, 0, fmt.Sprintf("frame type 0x%02x", frame.Type)))
+		}
+	}
+}
+
+// handleDataFrame delivers the datagram in a data frame, reporting failures to the peer
+func handleDataFrame(conn net.Conn, frame linkFrame, counter *int, sender sendUDPFn) {
+	sequenced := frame.Flags&frameFlagSequenced != 0
+	var seq uint32
+	if sequenced {
+		if len(frame.Body) < 4 {
+			incCounter("frames_malformed")
+			conn.Write(encodeErrorFrame(frameErrUnsupported, 0, 0, "data frame too short"))
+			return
+		}
+		seq = binary.BigEndian.Uint32(frame.Body[0:4])
+		frame.Body = frame.Body[4:]
+	}
+	if len(frame.Body) < 4 {
+		incCounter("frames_malformed")
+		conn.Write(encodeErrorFrame(frameErrUnsupported, 0, 0, "data frame too short"))
+		return
+	}
+	srcport := (uint(frame.Body[0]) << 8) + uint(frame.Body[1])
+	destport := (uint(frame.Body[2]) << 8) + uint(frame.Body[3])
+	data := frame.Body[4:]
+	var group, source net.IP
+	if frame.Flags&frameFlagMulticast != 0 {
+		var ok bool
+		group, data, ok = readFrameIP(data)
+		if ok {
+			source, data, ok = readFrameIP(data)
+		}
+		if !ok {
+			incCounter("frames_malformed")
+			conn.Write(encodeErrorFrame(frameErrUnsupported, srcport, destport, "bad multicast group"))
+			return
+		}
+	}
+	if srcport == 0 || srcport == 1023 || destport == 0 || destport == 1023 {
+		conn.Write(encodeErrorFrame(frameErrPortRefused, srcport, destport, "reserved port"))
+		return
+	}
+	if len(data) > MaxDatagramSize {
+		incCounter("frames_oversized")
+		conn.Write(encodeErrorFrame(frameErrTooLarge, srcport, destport, ""))
+		return
+	}
+	if frame.Flags&frameFlagCompressed != 0 {
+		var err error
+		data, err = decompressPayload(data)
+		if err == errDecompressedTooLarge {
+			incCounter("frames_oversized")
+			conn.Write(encodeErrorFrame(frameErrTooLarge, srcport, destport, ""))
+			return
+		}
+		if err != nil {
+			incCounter("decompress_failed")
+			conn.Write(encodeErrorFrame(frameErrUnsupported, srcport, destport, "bad compressed payload"))
+			return
+		}
+		incCounter("decompressed_frames")
+	}
+	if sequenced && !acceptSequence(conn, srcport, destport, seq) {
+		return
+	}
+	// room for the profiling timestamp
+	buf := make([]byte, len(data)+8)
+	copy(buf, data)
+	err := receivedPacket(conn, srcport, destport, group, source, buf, len(data), counter, sender)
+	if err != nil {
+		incCounter("delivery_failed")
+		conn.Write(encodeErrorFrame(frameErrDeliveryFailed, srcport, destport, err.Error()))
+	}
+}
+
+// handleErrorFrame logs and counts an error report from a peer
+func handleErrorFrame(conn net.Conn, frame linkFrame) {
+	if len(frame.Body) < 5 {
+		incCounter("frames_malformed")
+		return
+	}
+	code := frame.Body[0]
+	incCounter(fmt.Sprintf("peer_error:%s", frameErrorText(code)))
+	log.WithFields(
+		log.Fields{
+			"remote":   conn.RemoteAddr().String(),
+			"error":    frameErrorText(code),
+			"srcport":  (int(frame.Body[1]) << 8) + int(frame.Body[2]),
+			"destport": (int(frame.Body[3]) << 8) + int(frame.Body[4]),
+			"message":  string(frame.Body[5:]),
+		}).Warn("Peer reported an error")
+}
+
+// closeLink closes a connection to a peer, sending a close frame first if the peer
+// speaks typed frames
+func closeLink(conn Link) {
+	flushLink(conn)
+	if conn.Protocol() == linkProtocolV2 {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write(encodeFrame(frameTypeClose, 0, nil))
+	}
+	conn.Close()
+}
+
+// forgetConn removes a connection from the connection cache so the next packet for
+// the peer dials a new one
+func forgetConn(conn net.Conn) {
+	dropLink(conn)
+	linkCompression.Delete(conn)
+	dialedLinks.Delete(conn)
+	connMap.Range(func(key, value interface{}) bool {
+		if link, ok := value.(Link); ok && link == conn {
+			connMap.Delete(key)
+		}
+		return true
+	})
+	peerLinkClosed(addrIP(conn.RemoteAddr()))
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncodeReadFrame(t *testing.T) {
+	frame, err := readFrame(bytes.NewReader(encodeDataFrame(4000, 50300, 7, []byte{1, 2, 3})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Version != frameVersion || frame.Type != frameTypeData || frame.Flags != frameFlagSequenced {
+		t.Errorf("wrong frame version or type. Got %d and %d", frame.Version, frame.Type)
+	}
+	if !bytes.Equal(frame.Body, []byte{0, 0, 0, 7, 0x0F, 0xA0, 0xC4, 0x7C, 1, 2, 3}) {
+		t.Errorf("wrong frame body. Got %v", frame.Body)
+	}
+	_, err = readFrame(bytes.NewReader([]byte{frameVersion, frameTypeData, 0, 0, 5, 1}))
+	if err == nil {
+		t.Error("should have failed on a truncated frame")
+	}
+}
+
+func TestHandleFrames(t *testing.T) {
+	var delivered []uint
+	sender := func(srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte, counter int) error {
+		if destprt == 50301 {
+			return errors.New("port unreachable")
+		}
+		delivered = append(delivered, destprt)
+		return nil
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		handleFrames(server, bufio.NewReader(server), sender)
+		done <- true
+	}()
+	r := bufio.NewReader(client)
+	expectFrame := func(frameType byte, code byte) {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		frame, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != frameType {
+			t.Fatalf("wrong reply type. Got %d, expected %d", frame.Type, frameType)
+		}
+		if frameType == frameTypeError && frame.Body[0] != code {
+			t.Errorf("wrong error code. Got %d, expected %d", frame.Body[0], code)
+		}
+	}
+	// a data frame that's delivered gets no reply, so follow it with a ping
+	client.Write(encodeDataFrame(4000, 50300, 1, []byte{1, 2, 3}))
+	client.Write(encodeFrame(frameTypePing, 0, []byte{9}))
+	expectFrame(frameTypePong, 0)
+	if len(delivered) != 1 || delivered[0] != 50300 {
+		t.Errorf("data frame wasn't delivered. Got %v", delivered)
+	}
+	client.Write(encodeDataFrame(4000, 50301, 1, []byte{1, 2, 3}))
+	expectFrame(frameTypeError, frameErrDeliveryFailed)
+	client.Write(encodeDataFrame(4000, 1023, 1, []byte{1, 2, 3}))
+	expectFrame(frameTypeError, frameErrPortRefused)
+	client.Write(encodeFrame(0x7E, 0, nil))
+	expectFrame(frameTypeError, frameErrUnsupported)
+	client.Write(encodeFrame(frameTypeClose, 0, nil))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("close frame should have ended the link")
+	}
+}
+
+func TestLinkProtocol(t *testing.T) {
+	modifyKeyPathsWindows()
+	rootCAs := ConfigureRootCAs(&cacertpath)
+	cer, err := tls.LoadX509KeyPair(certpath, keypath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConf := &tls.Config{
+		RootCAs:      rootCAs,
+		Certificates: []tls.Certificate{cer},
+		ServerName:   "127.0.0.1",
+		NextProtos:   linkProtocols,
+	}
+	// a new peer negotiates typed frames, a peer from before typed frames negotiates the
+	// legacy framing, and a peer from before ALPN doesn't know about either
+	tests := []struct {
+		serverProtos []string
+		expected     string
+	}{
+		{linkProtocols, linkProtocolV2},
+		{[]string{linkProtocolV1}, linkProtocolV1},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		serverConf := &tls.Config{
+			Certificates: []tls.Certificate{cer},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    rootCAs,
+			NextProtos:   test.serverProtos,
+		}
+		c, s := net.Pipe()
+		client := tls.Client(c, clientConf)
+		server := tls.Server(s, serverConf)
+		serverProto := make(chan string)
+		go func() { serverProto <- linkProtocol(server) }()
+		clientProto := linkProtocol(client)
+		if clientProto != test.expected || <-serverProto != test.expected {
+			t.Errorf("wrong negotiated protocol. Got %q, expected %q", clientProto, test.expected)
+		}
+		if linkVersion(clientProto) == 0 {
+			t.Errorf("unknown link version for %q", clientProto)
+		}
+		// close the pipe under the TLS conns, there's no one to read a close_notify
+		c.Close()
+		s.Close()
+	}
+	// a peer with no version in common is refused in the handshake
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	futureConf := clientConf.Clone()
+	futureConf.NextProtos = []string{"udprx/9"}
+	server := tls.Server(s, &tls.Config{
+		Certificates: []tls.Certificate{cer},
+		NextProtos:   linkProtocols,
+	})
+	go server.Handshake()
+	err = tls.Client(c, futureConf).Handshake()
+	if !isProtocolMismatch(err) {
+		t.Errorf("handshake should have failed on the protocol. Got %v", err)
+	}
+}
+
+func TestCommonLinkProtocol(t *testing.T) {
+	protocol, err := commonLinkProtocol([]string{linkProtocolV1, linkProtocolV2})
+	if err != nil || protocol != linkProtocolV2 {
+		t.Errorf("should have picked the highest common version. Got %q, %v", protocol, err)
+	}
+	protocol, err = commonLinkProtocol([]string{"udprx/9", linkProtocolV1})
+	if err != nil || protocol != linkProtocolV1 {
+		t.Errorf("should have picked the only common version. Got %q, %v", protocol, err)
+	}
+	if protocol, err = commonLinkProtocol(nil); err != nil || protocol != "" {
+		t.Error("a peer that offers nothing should get the legacy framing")
+	}
+	if _, err = commonLinkProtocol([]string{"udprx/9"}); err == nil {
+		t.Error("should have refused a peer with no common version")
+	}
+}
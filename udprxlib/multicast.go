@@ -0,0 +1,227 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MulticastGroup is a multicast group that is forwarded between udp_rx peers. Both
+// sides of the tunnel configure the group with each other as peers
+type MulticastGroup struct {
+	// Group is the multicast group address
+	Group string `json:"group"`
+	// Ports are the UDP ports of the group that are forwarded
+	Ports []int `json:"ports"`
+	// Interface is the local interface to join the group on and re-emit packets to
+	Interface string `json:"interface"`
+	// Peers are the udp_rx peers (IP addresses or hostnames) subscribed to the group
+	Peers []string `json:"peers"`
+}
+
+// multicastGroups are the configured groups, set by ApplyConfig
+var multicastGroups []MulticastGroup
+
+// sendMulticastFunc re-emits a packet to a group, it's a variable so tests can mock it
+var sendMulticastFunc = SendMulticastUDP
+
+// multicastListeners is a map of "group:port" strings to the *net.UDPConn listening on them
+var multicastListeners = sync.Map{}
+
+// hasPort returns true if the port is forwarded for the group
+func (group *MulticastGroup) hasPort(port int) bool {
+	for _, p := range group.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPeer returns true if ip is the address of one of the group's peers
+func (group *MulticastGroup) hasPeer(ip string) bool {
+	return peersInclude(group.Peers, ip)
+}
+
+// peersInclude returns true if ip is the address of one of the peers in a list of
+// IP addresses and hostnames. It's called for every packet, so hostnames are only
+// matched against their cached addresses and never wait for DNS
+func peersInclude(peers []string, ip string) bool {
+	for _, peer := range peers {
+		if peer == ip {
+			return true
+		}
+		if net.ParseIP(peer) != nil {
+			continue
+		}
+		// peers can be hostnames, so check what they resolve to
+		for _, peerIP := range cachedHostIPs(peer) {
+			if peerIP.String() == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findMulticastGroup returns the configured group for a group address and port, or nil
+func findMulticastGroup(groupIP net.IP, port int) *MulticastGroup {
+	for i := range multicastGroups {
+		group := &multicastGroups[i]
+		if net.ParseIP(group.Group).Equal(groupIP) && group.hasPort(port) {
+			return group
+		}
+	}
+	return nil
+}
+
+// peerHeader returns a copy of header addressed to a peer, which is either an IP
+// address or a hostname
+func peerHeader(header UDPRxHeader, peer string) UDPRxHeader {
+	header.DestIPAddr = nil
+	header.DestHostname = ""
+	if ip := net.ParseIP(peer); ip != nil {
+		header.DestIPAddr = ip
+	} else {
+		header.DestHostname = peer
+	}
+	return header
+}
+
+// forwardMulticast sends a packet for a multicast group to every peer subscribed to it
+func forwardMulticast(clientConf *tls.Config, header UDPRxHeader, data []byte, srcIP net.IP, srcport int) {
+	group := findMulticastGroup(header.DestIPAddr, header.PortNumber)
+	if group == nil {
+		incCounter("multicast_no_group")
+		log.WithFields(
+			log.Fields{
+				"group": header.DestIPAddr.String(),
+				"port":  header.PortNumber,
+			}).Error("No multicast group configured for destination, dropping")
+		return
+	}
+	for _, peer := range group.Peers {
+		peerhdr := peerHeader(header, peer)
+		peerhdr.MulticastGroup = header.DestIPAddr
+		peerhdr.MulticastSource = srcIP
+		if peerhdr.DestIPAddr.IsMulticast() {
+			log.WithField("peer", peer).Error("Multicast group peer can't be a multicast address")
+			continue
+		}
+		dispatchPacket(clientConf, peerhdr, data, srcIP, srcport)
+	}
+}
+
+// deliverMulticast re-emits a packet a peer sent for a multicast group to the group on
+// the group's interface, from the original sender's IP and port. The group and port
+// must be configured with the peer
+func deliverMulticast(groupIP net.IP, sourceIP net.IP, remoteIP string, srcport uint, destport uint, data []byte) error {
+	group := findMulticastGroup(groupIP, int(destport))
+	if group == nil || !group.hasPeer(remoteIP) {
+		incCounter("multicast_no_group")
+		return fmt.Errorf("multicast group %s port %d isn't configured for the peer", groupIP.String(), destport)
+	}
+	rememberRelayed(relayKey(sourceIP.String(), srcport, group.Group, destport, data))
+	return sendMulticastFunc(group.Interface, sourceIP.String(), group.Group, srcport, destport, data)
+}
+
+// MulticastListener joins a multicast group on its interface and forwards locally
+// generated packets sent to the group on port to the group's peers, without a header
+func MulticastListener(group MulticastGroup, port int, clientConf *tls.Config, done chan error) {
+	groupIP := net.ParseIP(group.Group)
+	if groupIP == nil || !groupIP.IsMulticast() {
+		err := errors.New("invalid multicast group address")
+		log.WithFields(
+			log.Fields{
+				"error": err,
+				"group": group.Group,
+			}).Error("Invalid multicast group configuration")
+		done <- err
+		return
+	}
+	var ifi *net.Interface
+	if group.Interface != "" {
+		var err error
+		ifi, err = net.InterfaceByName(group.Interface)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error":     err,
+					"interface": group.Interface,
+				}).Error("Couldn't find multicast interface")
+			done <- err
+			return
+		}
+	}
+	// this joins the group on the interface
+	ServerConn, err := net.ListenMulticastUDP("udp", ifi, &net.UDPAddr{IP: groupIP, Port: port})
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error": err,
+				"group": group.Group,
+				"port":  port,
+			}).Error("Couldn't join multicast group")
+		done <- err
+		return
+	}
+	multicastListeners.Store(fmt.Sprintf("%s:%d", group.Group, port), ServerConn)
+	defer ServerConn.Close()
+
+	log.WithFields(log.Fields{
+		"group": group.Group,
+		"port":  port,
+	}).Info("Ready to accept multicast datagrams...")
+	readbuf := make([]byte, maxUDPReadSize)
+	for {
+		n, src, err := ServerConn.ReadFromUDP(readbuf)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error": err,
+					"group": group.Group,
+				}).Error("Error reading from multicast group. Terminating multicast thread.")
+			done <- err
+			return
+		}
+		data := make([]byte, n)
+		copy(data, readbuf[:n])
+		// don't capture packets that we re-emitted for a peer
+		if group.hasPeer(src.IP.String()) || wasRelayed(relayKey(src.IP.String(), uint(src.Port), group.Group, uint(port), data)) {
+			continue
+		}
+		if n > MaxDatagramSize {
+			incCounter("ingress_oversized")
+			continue
+		}
+		header := UDPRxHeader{
+			MajorVersion: 2,
+			PortNumber:   port,
+			DestIPAddr:   groupIP,
+		}
+		dispatchPacket(clientConf, header, data, src.IP, src.Port)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+package udprxlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMulticastGroupLookup(t *testing.T) {
+	multicastGroups = []MulticastGroup{
+		{Group: "239.1.2.3", Ports: []int{5000, 5001}, Peers: []string{"192.168.1.50", "192.168.2.50"}},
+	}
+	defer func() { multicastGroups = nil }()
+	if findMulticastGroup(net.ParseIP("239.1.2.3"), 5001) == nil {
+		t.Error("should have found the group")
+	}
+	if findMulticastGroup(net.ParseIP("239.1.2.3"), 6000) != nil {
+		t.Error("port isn't forwarded for the group")
+	}
+}
+
+func TestHasPeerCached(t *testing.T) {
+	group := MulticastGroup{Group: "239.1.2.3", Ports: []int{5000}, Peers: []string{"peer.example"}}
+	release := make(chan bool)
+	lookupIPFunc = func(host string) ([]net.IP, time.Duration, error) {
+		<-release
+		return []net.IP{net.IPv4(192, 168, 1, 60)}, 0, nil
+	}
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	defer forgetHost("peer.example")
+	// a hostname that isn't cached doesn't match until it's been looked up, and
+	// checking it doesn't wait for DNS
+	if group.hasPeer("192.168.1.60") {
+		t.Error("uncached hostname shouldn't match")
+	}
+	resolved := make(chan bool)
+	whenResolved("peer.example", func() { close(resolved) })
+	close(release)
+	<-resolved
+	if !group.hasPeer("192.168.1.60") {
+		t.Error("cached hostname should match")
+	}
+	if group.hasPeer("192.168.1.61") {
+		t.Error("other addresses shouldn't match")
+	}
+}
+
+func TestForwardMulticast(t *testing.T) {
+	multicastGroups = []MulticastGroup{
+		{Group: "239.1.2.3", Ports: []int{5000}, Peers: []string{"192.168.1.50", "192.168.2.50"}},
+	}
+	defer func() { multicastGroups = nil }()
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var peers []string
+	wg.Add(2)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		mutex.Lock()
+		peers = append(peers, header.DestIPAddr.String())
+		mutex.Unlock()
+		if header.PortNumber != 5000 {
+			t.Errorf("wrong port. Got %d", header.PortNumber)
+		}
+		if !header.MulticastGroup.Equal(net.ParseIP("239.1.2.3")) {
+			t.Errorf("packet should be marked for the group. Got %v", header.MulticastGroup)
+		}
+		if !header.MulticastSource.Equal(net.IPv4(192, 168, 1, 2)) {
+			t.Errorf("packet should carry its sender. Got %v", header.MulticastSource)
+		}
+		wg.Done()
+		return nil
+	}
+	defer func() { forwardPacketFunc = forwardPacket }()
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 5000, DestIPAddr: net.ParseIP("239.1.2.3")}
+	dispatchPacket(&tls.Config{}, header, []byte{1, 2, 3}, net.IPv4(192, 168, 1, 2), 4000)
+	wg.Wait()
+	sort.Strings(peers)
+	if len(peers) != 2 || peers[0] != "192.168.1.50" || peers[1] != "192.168.2.50" {
+		t.Errorf("packet should have gone to both peers. Got %v", peers)
+	}
+}
+
+func TestMulticastFrame(t *testing.T) {
+	frame, err := readFrame(bytes.NewReader(encodePayloadFrame(frameFlagSequenced, 4000, 5000, 7, net.ParseIP("239.1.2.3"), net.ParseIP("192.168.1.2"), []byte{1, 2})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Flags != frameFlagSequenced|frameFlagMulticast {
+		t.Errorf("wrong flags. Got %d", frame.Flags)
+	}
+	if !bytes.Equal(frame.Body, []byte{0, 0, 0, 7, 0x0F, 0xA0, 0x13, 0x88, 4, 239, 1, 2, 3, 4, 192, 168, 1, 2, 1, 2}) {
+		t.Errorf("wrong frame body. Got %v", frame.Body)
+	}
+}
+
+func TestReceivedMulticast(t *testing.T) {
+	// the pipe's remote address is "pipe", so that's the peer
+	multicastGroups = []MulticastGroup{
+		{Group: "239.1.2.3", Ports: []int{5000}, Peers: []string{"pipe"}},
+	}
+	defer func() { multicastGroups = nil }()
+	delivered := make(chan uint, 1)
+	sender := func(srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte, counter int) error {
+		delivered <- destprt
+		return nil
+	}
+	emitted := make(chan string, 1)
+	sendMulticastFunc = func(ifname string, srcipstr string, groupstr string, srcprt uint, destprt uint, data []byte) error {
+		emitted <- fmt.Sprintf("%s:%d>%s:%d", srcipstr, srcprt, groupstr, destprt)
+		return nil
+	}
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		handleFrames(server, bufio.NewReader(server), sender)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+		sendMulticastFunc = SendMulticastUDP
+	}()
+	// a unicast packet from a group peer to a group port is still unicast
+	client.Write(encodeDataFrame(4000, 5000, 1, []byte{1, 2, 3}))
+	select {
+	case port := <-delivered:
+		if port != 5000 {
+			t.Errorf("wrong port. Got %d", port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unicast packet wasn't delivered")
+	}
+	// a group packet is re-emitted from its original sender
+	client.Write(encodePayloadFrame(frameFlagSequenced, 4000, 5000, 2, net.ParseIP("239.1.2.3"), net.ParseIP("192.168.1.77"), []byte{1, 2, 3}))
+	select {
+	case src := <-emitted:
+		if src != "192.168.1.77:4000>239.1.2.3:5000" {
+			t.Errorf("wrong source or group. Got %s", src)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("multicast packet wasn't re-emitted")
+	}
+	// a group that isn't configured with the peer is refused
+	client.Write(encodePayloadFrame(frameFlagSequenced, 4000, 5000, 3, net.ParseIP("239.9.9.9"), net.ParseIP("192.168.1.77"), []byte{1, 2, 3}))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	frame, err := readFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != frameTypeError || frame.Body[0] != frameErrDeliveryFailed {
+		t.Errorf("should have been refused. Got type %d", frame.Type)
+	}
+	// a group without its sender is malformed
+	client.Write(encodeFrame(frameTypeData, frameFlagMulticast, []byte{0x0F, 0xA0, 0x13, 0x88, 4, 239, 1, 2, 3}))
+	frame, err = readFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != frameTypeError || frame.Body[0] != frameErrUnsupported {
+		t.Errorf("should have been malformed. Got type %d", frame.Type)
+	}
+	if len(delivered) != 0 || len(emitted) != 0 {
+		t.Error("refused multicast packets shouldn't have been delivered")
+	}
+	client.Write(encodeFrame(frameTypeClose, 0, nil))
+}
@@ -0,0 +1,145 @@
+// +build linux
+
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// BroadcastListener captures broadcasts sent to port on the relay's interface and
+// forwards them to the relay's peers. Only IPv4 is supported. A socket is bound to each
+// broadcast address rather than to the port, so unicast to the port is never captured
+func BroadcastListener(relay BroadcastRelay, port int, clientConf *tls.Config, done chan error) {
+	addrs, err := broadcastBindAddrs(&relay)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error":     err,
+				"interface": relay.Interface,
+				"port":      port,
+			}).Error("Couldn't find the broadcast addresses for broadcast relay")
+		done <- err
+		return
+	}
+	var conns []*net.UDPConn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		conn, err := listenBroadcast(relay.Interface, addr, port)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"address":   addr,
+					"error":     err,
+					"interface": relay.Interface,
+					"port":      port,
+				}).Error("Couldn't Listen to UDP for broadcast relay")
+			done <- err
+			return
+		}
+		conns = append(conns, conn)
+		broadcastListeners.Store(fmt.Sprintf("%s:%s:%d", relay.Interface, addr, port), conn)
+	}
+
+	log.WithFields(log.Fields{
+		"interface": relay.Interface,
+		"port":      port,
+	}).Info("Ready to accept broadcast datagrams...")
+	// the first socket to fail ends the listener and closes the others
+	readDone := make(chan error, len(conns))
+	for _, conn := range conns {
+		go readBroadcasts(conn, &relay, port, clientConf, readDone)
+	}
+	done <- <-readDone
+}
+
+// listenBroadcast binds a socket to a broadcast address and port on the relay's interface
+func listenBroadcast(ifname string, addr net.IP, port int) (*net.UDPConn, error) {
+	listenConfig := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return setBroadcastSockopts(c, ifname)
+	}}
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp4", fmt.Sprintf("%s:%d", addr, port))
+	if err != nil {
+		return nil, err
+	}
+	return packetConn.(*net.UDPConn), nil
+}
+
+// readBroadcasts forwards the broadcasts received on conn until reading fails
+func readBroadcasts(conn *net.UDPConn, relay *BroadcastRelay, port int, clientConf *tls.Config, done chan error) {
+	readbuf := make([]byte, maxUDPReadSize)
+	for {
+		n, src, err := conn.ReadFromUDP(readbuf)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"address": conn.LocalAddr(),
+					"error":   err,
+					"port":    port,
+				}).Error("Error reading from broadcast relay port. Terminating broadcast thread.")
+			done <- err
+			return
+		}
+		data := make([]byte, n)
+		copy(data, readbuf[:n])
+		dest := conn.LocalAddr().(*net.UDPAddr).IP
+		// don't capture broadcasts that we re-broadcast for a peer
+		if relay.hasPeer(src.IP.String()) || wasRelayed(relayKey(src.IP.String(), uint(src.Port), dest.String(), uint(port), data)) {
+			continue
+		}
+		if n > MaxDatagramSize {
+			incCounter("ingress_oversized")
+			continue
+		}
+		forwardBroadcast(clientConf, relay, port, data, src.IP, src.Port)
+	}
+}
+
+// setBroadcastSockopts lets several relays share a broadcast address and port, and binds
+// the socket to the relay's interface. Sockets are bound to broadcast addresses, so
+// SO_REUSEADDR doesn't let them take unicast from a program listening on the port
+func setBroadcastSockopts(c syscall.RawConn, ifname string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr != nil {
+			return
+		}
+		if ifname != "" {
+			sockErr = unix.BindToDevice(int(fd), ifname)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,72 @@
+// +build linux
+
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBroadcastBindAddrs(t *testing.T) {
+	addrs, err := broadcastBindAddrs(&BroadcastRelay{Interface: "lo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || !addrs[0].Equal(net.IPv4bcast) || addrs[1].String() != "127.255.255.255" {
+		t.Errorf("should capture the limited and loopback broadcasts. Got %v", addrs)
+	}
+	_, err = broadcastBindAddrs(&BroadcastRelay{Interface: "nosuchif0"})
+	if err == nil {
+		t.Error("should have failed for a missing interface")
+	}
+}
+
+func TestListenBroadcastIgnoresUnicast(t *testing.T) {
+	conn, err := listenBroadcast("lo", net.IPv4(127, 255, 255, 255), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	send := func(dest string) {
+		sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(dest), Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sender.Close()
+		if _, err := sender.Write([]byte(dest)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("127.0.0.1")
+	send("127.255.255.255")
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "127.255.255.255" {
+		t.Errorf("should only have received the broadcast. Got %s", buf[:n])
+	}
+}
@@ -25,6 +25,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"net"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -48,6 +50,22 @@ func CreateUDPSocket() error {
 		unix.Close(fd)
 		return err
 	}
+	// allow relayed broadcasts to be sent
+	err = unix.SetsockoptInt(tfd, unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+	if err != nil {
+		log.Fatal("couldn't enable broadcast on socket", err)
+		unix.Close(tfd)
+		return err
+	}
+	// mark delivered packets so the firewall can send replies to the transparent listener
+	if ReplySessions {
+		err = unix.SetsockoptInt(tfd, unix.SOL_SOCKET, unix.SO_MARK, SessionMark)
+		if err != nil {
+			log.Fatal("couldn't set session mark on socket", err)
+			unix.Close(tfd)
+			return err
+		}
+	}
 	log.Info("socket created and set")
 	// set fd after success and return no-error
 	fd = tfd
@@ -56,6 +74,58 @@ func CreateUDPSocket() error {
 
 // SendUDP takes in the associated data and puts a UDP packet on the wire
 func SendUDP(srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte, counter int) error {
+	return sendRawUDP(fd, 64, srcipstr, destipstr, srcprt, destprt, data)
+}
+
+// multicastFds is a map of interface names to raw sockets that send multicast on them
+var multicastFds = make(map[string]int)
+var multicastFdsMutex = &sync.Mutex{}
+
+// SendMulticastUDP puts a UDP packet for a multicast group on the wire of the named
+// interface. Multicast is sent with a TTL of 1 so it stays on the local network
+func SendMulticastUDP(ifname string, srcipstr string, groupstr string, srcprt uint, destprt uint, data []byte) error {
+	mfd, err := getMulticastFd(ifname)
+	if err != nil {
+		return err
+	}
+	return sendRawUDP(mfd, 1, srcipstr, groupstr, srcprt, destprt, data)
+}
+
+// getMulticastFd gets or creates a raw socket that sends multicast out of an interface
+func getMulticastFd(ifname string) (int, error) {
+	multicastFdsMutex.Lock()
+	defer multicastFdsMutex.Unlock()
+	if mfd, ok := multicastFds[ifname]; ok {
+		return mfd, nil
+	}
+	mfd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		return -1, err
+	}
+	err = unix.SetsockoptInt(mfd, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+	if err != nil {
+		unix.Close(mfd)
+		return -1, err
+	}
+	if ifname != "" {
+		ifi, err := net.InterfaceByName(ifname)
+		if err != nil {
+			unix.Close(mfd)
+			return -1, err
+		}
+		mreq := &unix.IPMreqn{Ifindex: int32(ifi.Index)}
+		err = unix.SetsockoptIPMreqn(mfd, unix.IPPROTO_IP, unix.IP_MULTICAST_IF, mreq)
+		if err != nil {
+			unix.Close(mfd)
+			return -1, err
+		}
+	}
+	multicastFds[ifname] = mfd
+	return mfd, nil
+}
+
+// sendRawUDP builds the IP and UDP headers for a packet and writes it to a raw socket
+func sendRawUDP(rawfd int, ttl uint8, srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte) error {
 	// parse the ips
 	srcip, destip, err := ParseIps(srcipstr, destipstr)
 	if err != nil {
@@ -68,7 +138,7 @@ func SendUDP(srcipstr string, destipstr string, srcprt uint, destprt uint, data
 		tos:   0,
 		id:    0x1234, // the kernel overwrites id if it is zero
 		off:   0,
-		ttl:   64,
+		ttl:   ttl,
 		proto: unix.IPPROTO_UDP,
 	}
 	// copy the ip addresses to the IP header
@@ -112,10 +182,10 @@ func SendUDP(srcipstr string, destipstr string, srcprt uint, destprt uint, data
 		return err
 	}
 	bb := b.Bytes()
-	err = unix.Sendto(fd, bb, 0, &addr)
+	err = unix.Sendto(rawfd, bb, 0, &addr)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"fd":   fd,
+			"fd":   rawfd,
 			"bb":   bb,
 			"addr": addr,
 		}).Error("Error in unix.Sendto")
@@ -0,0 +1,141 @@
+// +build linux
+
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// TransparentSocketListener is the udp socket listener for transparent interception
+var TransparentSocketListener *net.UDPConn
+
+// TransparentListener receives datagrams that an iptables TPROXY rule redirected to port
+// and forwards each one to the destination the application originally sent it to.
+// Only IPv4 is supported
+func TransparentListener(listenAddrFlag *string, port int, clientConf *tls.Config, done chan error) {
+	listenConfig := net.ListenConfig{Control: setTransparentSockopts}
+	listenAddr := fmt.Sprintf("%s:%d", *listenAddrFlag, port)
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp4", listenAddr)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error": err,
+			}).Error("Couldn't Listen to UDP for transparent interception")
+		done <- err
+		return
+	}
+	ServerConn := packetConn.(*net.UDPConn)
+	TransparentSocketListener = ServerConn
+	defer ServerConn.Close()
+
+	log.Info("Ready to accept transparent connections...")
+	readbuf := make([]byte, maxUDPReadSize)
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofSockaddrInet6))
+	for {
+		n, oobn, _, src, err := ServerConn.ReadMsgUDP(readbuf, oob)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error": err,
+				}).Error("Error reading from transparent UDP port. Terminating transparent thread.")
+			done <- err
+			return
+		}
+		origDst, err := parseOrigDst(oob[:oobn])
+		if err != nil {
+			incCounter("ingress_malformed")
+			log.WithFields(
+				log.Fields{
+					"error": err,
+				}).Error("Couldn't get original destination. continuing.")
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, readbuf[:n])
+		// replies to a delivered packet go back over the link the packet came in on
+		if s := findSession(src.IP.String(), uint(src.Port), origDst.IP.String(), uint(origDst.Port)); s != nil {
+			sendReply(s, data)
+			continue
+		}
+		if n > MaxDatagramSize {
+			incCounter("ingress_oversized")
+			log.WithFields(
+				log.Fields{
+					"length": n,
+					"max":    MaxDatagramSize,
+				}).Error("Datagram larger than the max datagram size, dropping.")
+			continue
+		}
+		header := UDPRxHeader{
+			MajorVersion: 2,
+			PortNumber:   origDst.Port,
+			DestIPAddr:   origDst.IP,
+		}
+		dispatchPacket(clientConf, header, data, src.IP, src.Port)
+	}
+}
+
+// setTransparentSockopts lets the socket accept packets for non-local addresses and
+// asks the kernel to report the original destination of each packet
+func setTransparentSockopts(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		if sockErr != nil {
+			return
+		}
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseOrigDst finds the IP_ORIGDSTADDR control message and returns the address in it
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_IP || msg.Header.Type != unix.IP_ORIGDSTADDR {
+			continue
+		}
+		if len(msg.Data) < unix.SizeofSockaddrInet4 {
+			return nil, errors.New("original destination address too short")
+		}
+		// the port and address in a sockaddr_in are in network byte order
+		port := (int(msg.Data[2]) << 8) + int(msg.Data[3])
+		ip := net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7])
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return nil, errors.New("no original destination address in packet")
+}
@@ -0,0 +1,53 @@
+// +build linux
+
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOrigDst(t *testing.T) {
+	// build an IP_ORIGDSTADDR control message for 192.168.1.50:50300
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofSockaddrInet4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.SOL_IP
+	h.Type = unix.IP_ORIGDSTADDR
+	h.SetLen(unix.CmsgLen(unix.SizeofSockaddrInet4))
+	data := oob[unix.CmsgLen(0):]
+	data[2] = 0xC4
+	data[3] = 0x7C
+	copy(data[4:], []byte{192, 168, 1, 50})
+	addr, err := parseOrigDst(oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.IP.String() != "192.168.1.50" || addr.Port != 50300 {
+		t.Errorf("wrong original destination. Got %s", addr.String())
+	}
+	_, err = parseOrigDst([]byte{})
+	if err == nil {
+		t.Error("should have failed with no control messages")
+	}
+}
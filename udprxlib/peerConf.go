@@ -0,0 +1,185 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+)
+
+// PeerConf is the configuration for a single udp_rx peer
+type PeerConf struct {
+	// Address is the IP address or hostname of the peer
+	Address string `json:"address"`
+	// RemotePort overrides the TLS port of the peer, for sites that map it through a
+	// NAT. 0 uses the default remote port
+	RemotePort int `json:"remotePort"`
+	// AlwaysUp peers are dialed at startup and re-dialed whenever their connection
+	// goes away, instead of waiting for traffic
+	AlwaysUp bool `json:"alwaysUp"`
+	// Transport is "tls" or "dtls". Empty uses TLS
+	Transport string `json:"transport"`
+	// Connections is the number of connections flows to the peer are spread over.
+	// 0 uses ConnectionsPerPeer
+	Connections int `json:"connections"`
+	// PinnedPorts are destination ports that get a connection to the peer of their own
+	PinnedPorts []int `json:"pinnedPorts"`
+	// Compression is "deflate" to compress payloads to the peer if it supports it.
+	// Empty sends them uncompressed
+	Compression string `json:"compression"`
+}
+
+// peerConfs are the configured peers, set by ApplyConfig
+var peerConfs []PeerConf
+
+// peerAddresses returns the addresses of a list of peers
+func peerAddresses(peers []PeerConf) []string {
+	addrs := make([]string, len(peers))
+	for i, peer := range peers {
+		addrs[i] = peer.Address
+	}
+	return addrs
+}
+
+// ConnectionsPerPeer is the number of connections flows to a peer are spread over,
+// unless the peer sets its own
+var ConnectionsPerPeer = 1
+
+// maxConnectionsPerPeer limits the connections to a single peer
+const maxConnectionsPerPeer = 64
+
+// peerLanes returns the number of connections flows to the peer a header is
+// addressed to are hashed over, and the ports pinned to connections of their own
+func peerLanes(header UDPRxHeader) (int, []int) {
+	peer := peerConfFor(header)
+	if peer == nil {
+		return ConnectionsPerPeer, nil
+	}
+	if peer.Connections > 0 {
+		return peer.Connections, peer.PinnedPorts
+	}
+	return ConnectionsPerPeer, peer.PinnedPorts
+}
+
+// laneFor returns which connection to a header's peer packets from srcport are sent
+// on. Every packet of a flow goes the same way so the flow stays in order. Pinned
+// ports come after the hashed connections
+func laneFor(header UDPRxHeader, srcport int) int {
+	connections, pinned := peerLanes(header)
+	for i, port := range pinned {
+		if port == header.PortNumber {
+			return connections + i
+		}
+	}
+	if connections <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(append(intToBytes(srcport), intToBytes(header.PortNumber)...))
+	return int(h.Sum32() % uint32(connections))
+}
+
+// connKey returns the connection cache key for one of the connections to a header's
+// peer. The first connection is "dest|src", which links from the peer are cached
+// under too, and the others are "dest|src#lane"
+func connKey(header UDPRxHeader, lane int) string {
+	var key string
+	if len(header.SourceIPAddr) > 0 {
+		key = fmt.Sprintf("%s|%s", header.DestIPAddr.String(), header.SourceIPAddr.String())
+	} else {
+		key = fmt.Sprintf("%s|", header.DestIPAddr.String())
+	}
+	if lane > 0 {
+		key = fmt.Sprintf("%s#%d", key, lane)
+	}
+	return key
+}
+
+// peerConfFor returns the configuration of the peer a header is addressed to, or nil
+// if the peer isn't configured. It's on the path of every packet, so hostname peers
+// are matched against their cached addresses
+func peerConfFor(header UDPRxHeader) *PeerConf {
+	for i := range peerConfs {
+		peer := &peerConfs[i]
+		if header.DestHostname != "" && peer.Address == header.DestHostname {
+			return peer
+		}
+		if header.DestIPAddr != nil && peersInclude([]string{peer.Address}, header.DestIPAddr.String()) {
+			return peer
+		}
+	}
+	return nil
+}
+
+// remotePortFor returns the ":port" of the TLS server of the peer a header is addressed to
+func remotePortFor(header UDPRxHeader) string {
+	if peer := peerConfFor(header); peer != nil && peer.RemotePort != 0 {
+		return fmt.Sprintf(":%d", peer.RemotePort)
+	}
+	return RemoteTLSPort
+}
+
+// validPort returns an error if port isn't a usable TCP or UDP port number
+func validPort(name string, port int) error {
+	if port <= 0 || port > 0xFFFF {
+		return fmt.Errorf("invalid %s %d", name, port)
+	}
+	return nil
+}
+
+// validatePeerConfs checks the peer configuration from the config file
+func validatePeerConfs(peers []PeerConf) error {
+	for _, peer := range peers {
+		if peer.Address == "" {
+			return fmt.Errorf("peer has no address")
+		}
+		if peer.RemotePort != 0 {
+			if err := validPort("peer remote port", peer.RemotePort); err != nil {
+				return err
+			}
+		}
+		if peer.Connections < 0 || peer.Connections > maxConnectionsPerPeer {
+			return fmt.Errorf("invalid number of connections %d to peer %s", peer.Connections, peer.Address)
+		}
+		for _, port := range peer.PinnedPorts {
+			if err := validPort("pinned port", port); err != nil {
+				return err
+			}
+		}
+		if peer.Compression != "" {
+			if err := validCompression(peer.Compression); err != nil {
+				return err
+			}
+		}
+		if peer.Transport != "" {
+			if err := validTransport(peer.Transport); err != nil {
+				return err
+			}
+		}
+		// catch "host:port" typos, the port has its own setting
+		if net.ParseIP(peer.Address) == nil {
+			if _, _, err := net.SplitHostPort(peer.Address); err == nil {
+				return fmt.Errorf("peer address %q includes a port, use remotePort", peer.Address)
+			}
+		}
+	}
+	return nil
+}
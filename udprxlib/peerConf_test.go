@@ -0,0 +1,197 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRemotePortFor(t *testing.T) {
+	peerConfs = []PeerConf{
+		{Address: "192.168.1.50", RemotePort: 45554},
+		{Address: "site2.example.local", RemotePort: 45555},
+		{Address: "192.168.1.51"},
+	}
+	defer func() { peerConfs = nil }()
+	// don't look the hostname peer up in real DNS
+	lookupIPFunc = func(host string) ([]net.IP, time.Duration, error) {
+		return []net.IP{net.ParseIP("10.0.0.2")}, 0, nil
+	}
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	defer forgetHost("site2.example.local")
+	// an address of a hostname peer isn't matched until the hostname is cached
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("10.0.0.2")}
+	if port := remotePortFor(header); port != RemoteTLSPort {
+		t.Errorf("uncached hostname peer should use the default. Got %s", port)
+	}
+	resolved := make(chan bool)
+	whenResolved("site2.example.local", func() { close(resolved) })
+	<-resolved
+	if port := remotePortFor(header); port != ":45555" {
+		t.Errorf("wrong remote port for an address of a hostname peer. Got %s", port)
+	}
+	header = UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.1.50")}
+	if port := remotePortFor(header); port != ":45554" {
+		t.Errorf("wrong remote port. Got %s", port)
+	}
+	header.DestIPAddr = net.ParseIP("192.168.1.51")
+	if port := remotePortFor(header); port != RemoteTLSPort {
+		t.Errorf("peer without a port should use the default. Got %s", port)
+	}
+	header.DestIPAddr = net.ParseIP("192.168.1.52")
+	if port := remotePortFor(header); port != RemoteTLSPort {
+		t.Errorf("unconfigured peer should use the default. Got %s", port)
+	}
+	header = UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestHostname: "site2.example.local", DestIPAddr: net.ParseIP("10.0.0.1")}
+	if port := remotePortFor(header); port != ":45555" {
+		t.Errorf("wrong remote port for hostname peer. Got %s", port)
+	}
+}
+
+func TestValidatePeerConfs(t *testing.T) {
+	invalid := []PeerConf{
+		{},
+		{Address: "192.168.1.50", RemotePort: 70000},
+		{Address: "site2.example.local:45554"},
+		{Address: "192.168.1.50", Connections: -1},
+		{Address: "192.168.1.50", Connections: 65},
+		{Address: "192.168.1.50", PinnedPorts: []int{0}},
+		{Address: "192.168.1.50", Transport: "udp"},
+		{Address: "192.168.1.50", Compression: "lz4"},
+	}
+	for _, peer := range invalid {
+		if validatePeerConfs([]PeerConf{peer}) == nil {
+			t.Errorf("should have rejected %v", peer)
+		}
+	}
+	if err := validatePeerConfs([]PeerConf{{Address: "fe80::1", RemotePort: 45554}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeerHostsPrefetched(t *testing.T) {
+	looked := make(chan string, 1)
+	lookupIPFunc = func(host string) ([]net.IP, time.Duration, error) {
+		looked <- host
+		return []net.IP{net.ParseIP("10.0.0.3")}, 0, nil
+	}
+	defer func() { lookupIPFunc = lookupIPTTL }()
+	defer forgetHost("site3.example.local")
+	err := ApplyConfig(ConfFile{Peers: []PeerConf{{Address: "192.168.1.50"}, {Address: "site3.example.local"}}})
+	defer func() { peerConfs = nil }()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case host := <-looked:
+		if host != "site3.example.local" {
+			t.Errorf("looked up the wrong host. Got %s", host)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hostname peer wasn't looked up")
+	}
+	resolved := make(chan bool)
+	whenResolved("site3.example.local", func() { close(resolved) })
+	<-resolved
+	if peerConfFor(UDPRxHeader{DestIPAddr: net.ParseIP("10.0.0.3")}) == nil {
+		t.Error("address of the hostname peer should find its configuration")
+	}
+}
+
+func TestLaneFor(t *testing.T) {
+	peerConfs = []PeerConf{{Address: "192.168.1.50", Connections: 4, PinnedPorts: []int{50301, 50302}}}
+	defer func() { peerConfs = nil }()
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.1.50")}
+	lanes := make(map[int]bool)
+	for srcport := 4000; srcport < 4100; srcport++ {
+		lane := laneFor(header, srcport)
+		if lane < 0 || lane >= 4 {
+			t.Fatalf("hashed lane out of range. Got %d", lane)
+		}
+		if laneFor(header, srcport) != lane {
+			t.Fatal("a flow should always get the same lane")
+		}
+		lanes[lane] = true
+	}
+	if len(lanes) != 4 {
+		t.Errorf("flows should be spread over every connection. Got %v", lanes)
+	}
+	// pinned ports get their own connections after the hashed ones
+	for i, port := range []int{50301, 50302} {
+		header.PortNumber = port
+		if lane := laneFor(header, 4000); lane != 4+i {
+			t.Errorf("wrong lane for pinned port %d. Got %d", port, lane)
+		}
+	}
+	header.DestIPAddr = net.ParseIP("192.168.1.51")
+	if lane := laneFor(header, 4000); lane != 0 {
+		t.Errorf("unconfigured peer should have one connection. Got lane %d", lane)
+	}
+	if key := connKey(header, 0); key != "192.168.1.51|" {
+		t.Errorf("wrong key for the first connection. Got %s", key)
+	}
+	header.SourceIPAddr = net.ParseIP("192.168.1.10")
+	if key := connKey(header, 2); key != "192.168.1.51|192.168.1.10#2" {
+		t.Errorf("wrong key for a later connection. Got %s", key)
+	}
+}
+
+func TestPinnedPortConnection(t *testing.T) {
+	mem, _ := useMemTransport(t, []PeerConf{{Address: "192.168.7.5", Transport: "mem", PinnedPorts: []int{50301}}})
+	ln, err := mem.Listen("192.168.7.5:55554", &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan bool, 3)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- true
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	header := UDPRxHeader{MajorVersion: 1, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.7.5")}
+	defer removeConn(header)
+	pinned := header
+	pinned.PortNumber = 50301
+	for _, h := range []UDPRxHeader{header, pinned, header} {
+		if err := forwardPacket(&tls.Config{}, h, []byte{1}, 4000, ":55554"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(accepted) != 2 {
+		t.Errorf("wrong number of connections. Got %d", len(accepted))
+	}
+	if _, ok := connMap.Load("192.168.7.5|"); !ok {
+		t.Error("hashed flow should have used the first connection")
+	}
+	if _, ok := connMap.Load("192.168.7.5|#1"); !ok {
+		t.Error("pinned port should have its own connection")
+	}
+}
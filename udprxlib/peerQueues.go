@@ -0,0 +1,187 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+// queue drop policies, for when a packet arrives for a full queue
+const (
+	// DropOldest throws away the oldest queued packet to make room
+	DropOldest = "dropOldest"
+	// DropNewest throws away the packet that just arrived
+	DropNewest = "dropNewest"
+)
+
+// QueueDepth is the most packets that can wait to be sent to a single peer
+var QueueDepth = 1024
+
+// QueueIdleTimeout is how long a queue's writer waits for a packet before the queue
+// is removed
+var QueueIdleTimeout = time.Minute
+
+// QueueDropPolicy is what happens to packets for a full queue, DropOldest or DropNewest
+var QueueDropPolicy = DropOldest
+
+// errQueueFull is the result of a packet that was dropped from a full queue
+var errQueueFull = errors.New("peer send queue is full")
+
+// queuedPacket is a packet waiting for its turn to be forwarded. If done isn't nil
+// it's called with the outcome of the send
+type queuedPacket struct {
+	conf          *tls.Config
+	header        UDPRxHeader
+	data          []byte
+	srcport       int
+	remoteTLSPort string
+	done          func(error)
+}
+
+// peerQueue is the packets waiting to be sent on one connection, in ingress order.
+// A single writer goroutine sends them, so they can't overtake each other. A queue
+// that's closed has been removed from peerQueues and its writer has stopped
+type peerQueue struct {
+	mutex   sync.Mutex
+	key     string
+	packets []queuedPacket
+	ready   chan bool
+	closed  bool
+	// idleTimeout is QueueIdleTimeout when the queue was created
+	idleTimeout time.Duration
+}
+
+// peerQueues is a map of connection keys (the same as connMap's) to *peerQueue
+var peerQueues = sync.Map{}
+
+// queueKey returns the connection key packets from srcport to a header's destination
+// are queued under, so flows on different connections don't wait for each other
+func queueKey(header UDPRxHeader, srcport int) string {
+	return connKey(header, laneFor(header, srcport))
+}
+
+// getPeerQueue gets or creates the queue for a connection key, starting its writer
+func getPeerQueue(key string) *peerQueue {
+	q, ok := peerQueues.Load(key)
+	if ok {
+		return q.(*peerQueue)
+	}
+	newq := &peerQueue{key: key, ready: make(chan bool, 1), idleTimeout: QueueIdleTimeout}
+	q, loaded := peerQueues.LoadOrStore(key, newq)
+	if !loaded {
+		go newq.run()
+	}
+	return q.(*peerQueue)
+}
+
+// enqueuePacket queues a packet to be forwarded to the peer in its header. If done
+// isn't nil it's called with the outcome of the send, from the queue's writer
+func enqueuePacket(conf *tls.Config, header UDPRxHeader, data []byte, srcport int, remoteTLSPort string, done func(error)) {
+	packet := queuedPacket{conf, header, data, srcport, remoteTLSPort, done}
+	key := queueKey(header, srcport)
+	q := getPeerQueue(key)
+	q.mutex.Lock()
+	// the queue went idle and was removed after we found it, so start a new one
+	for q.closed {
+		q.mutex.Unlock()
+		q = getPeerQueue(key)
+		q.mutex.Lock()
+	}
+	if len(q.packets) >= QueueDepth {
+		var dropped queuedPacket
+		if QueueDropPolicy == DropNewest {
+			dropped = packet
+		} else {
+			dropped = q.packets[0]
+			q.packets[0] = queuedPacket{}
+			q.packets = append(q.packets[1:], packet)
+		}
+		q.mutex.Unlock()
+		incCounter("queue_dropped")
+		if dropped.done != nil {
+			dropped.done(errQueueFull)
+		}
+		if QueueDropPolicy == DropNewest {
+			return
+		}
+	} else {
+		q.packets = append(q.packets, packet)
+		q.mutex.Unlock()
+	}
+	incCounter("queue_enqueued")
+	// wake the writer if it's waiting
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// run sends the queued packets in order, until no packets arrive for QueueIdleTimeout
+func (q *peerQueue) run() {
+	idle := time.NewTimer(q.idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-q.ready:
+		case <-idle.C:
+			q.mutex.Lock()
+			if len(q.packets) == 0 {
+				q.closed = true
+				peerQueues.CompareAndDelete(q.key, q)
+				q.mutex.Unlock()
+				return
+			}
+			q.mutex.Unlock()
+		}
+		for {
+			q.mutex.Lock()
+			if len(q.packets) == 0 {
+				q.mutex.Unlock()
+				break
+			}
+			packet := q.packets[0]
+			// don't keep the packet alive through the backing array
+			q.packets[0] = queuedPacket{}
+			q.packets = q.packets[1:]
+			q.mutex.Unlock()
+			// packets for a peer that can't be reached wait for it in its pending buffer
+			buffered, err := forwardOrBuffer(packet)
+			if !buffered {
+				finishPacket(packet, err)
+			}
+		}
+		idle.Reset(q.idleTimeout)
+	}
+}
+
+// finishPacket counts the outcome of sending a packet and reports it to the sender
+func finishPacket(packet queuedPacket, err error) {
+	if err != nil {
+		incCounter("queue_send_failed")
+	} else {
+		incCounter("queue_sent")
+	}
+	if packet.done != nil {
+		packet.done(err)
+	}
+}
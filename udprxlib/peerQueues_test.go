@@ -0,0 +1,126 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueOrder queues packets 0-4 for a peer while the writer is stuck on packet 0,
+// and returns the order they were sent in once 4 of them have been sent
+func queueOrder(t *testing.T, dest net.IP, policy string) []byte {
+	oldDepth, oldPolicy := QueueDepth, QueueDropPolicy
+	QueueDepth, QueueDropPolicy = 3, policy
+	defer func() { QueueDepth, QueueDropPolicy = oldDepth, oldPolicy }()
+	var mutex sync.Mutex
+	var sent []byte
+	var wg sync.WaitGroup
+	wg.Add(4)
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		if data[0] == 0 {
+			started <- true
+			<-release
+		}
+		mutex.Lock()
+		sent = append(sent, data[0])
+		mutex.Unlock()
+		wg.Done()
+		return nil
+	}
+	defer func() { forwardPacketFunc = forwardPacket }()
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: dest}
+	enqueuePacket(&tls.Config{}, header, []byte{0}, 4000, RemoteTLSPort, nil)
+	<-started
+	for i := byte(1); i < 5; i++ {
+		enqueuePacket(&tls.Config{}, header, []byte{i}, 4000, RemoteTLSPort, nil)
+	}
+	close(release)
+	drained := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue wasn't drained")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return sent
+}
+
+func TestPeerQueueDropOldest(t *testing.T) {
+	sent := queueOrder(t, net.ParseIP("192.168.5.1"), DropOldest)
+	if string(sent) != string([]byte{0, 2, 3, 4}) {
+		t.Errorf("wrong send order. Got %v", sent)
+	}
+}
+
+func TestPeerQueueDropNewest(t *testing.T) {
+	before := GetCounters()["queue_dropped"]
+	sent := queueOrder(t, net.ParseIP("192.168.5.2"), DropNewest)
+	if string(sent) != string([]byte{0, 1, 2, 3}) {
+		t.Errorf("wrong send order. Got %v", sent)
+	}
+	if GetCounters()["queue_dropped"] != before+1 {
+		t.Error("dropped packet wasn't counted")
+	}
+}
+
+func TestPeerQueueIdle(t *testing.T) {
+	oldTimeout := QueueIdleTimeout
+	QueueIdleTimeout = 50 * time.Millisecond
+	defer func() { QueueIdleTimeout = oldTimeout }()
+	sent := make(chan bool, 2)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		sent <- true
+		return nil
+	}
+	defer func() { forwardPacketFunc = forwardPacket }()
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.5.3")}
+	key := queueKey(header, 4000)
+	enqueuePacket(&tls.Config{}, header, []byte{0}, 4000, RemoteTLSPort, nil)
+	<-sent
+	// the idle queue is removed and its writer stops
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := peerQueues.Load(key); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle queue wasn't removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a packet for the peer after that gets a new queue
+	enqueuePacket(&tls.Config{}, header, []byte{1}, 4000, RemoteTLSPort, nil)
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet after the queue was removed wasn't sent")
+	}
+}
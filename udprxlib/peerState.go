@@ -0,0 +1,196 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peer connection states
+const (
+	// PeerIdle peers have no links and haven't failed since they last had one
+	PeerIdle = "idle"
+	// PeerConnecting peers are being dialed
+	PeerConnecting = "connecting"
+	// PeerUp peers have at least one link
+	PeerUp = "up"
+	// PeerBackingOff peers failed to connect, and won't be dialed before NextRetry
+	PeerBackingOff = "backing-off"
+)
+
+// BackoffMin is how long a peer is left alone after its first failed dial. Each
+// failure after that doubles it, up to BackoffMax
+var BackoffMin = time.Second
+
+// BackoffMax is the longest a peer is left alone after failed dials
+var BackoffMax = 2 * time.Minute
+
+// PeerStatus is the connection state of a peer
+type PeerStatus struct {
+	State string
+	// Failures is the number of dials that have failed in a row
+	Failures int
+	// NextRetry is when a backing-off peer can be dialed again
+	NextRetry time.Time
+}
+
+// peerState tracks the connection state of a peer across all of its links. A state
+// that's removed has been deleted from peerStates
+type peerState struct {
+	mutex   sync.Mutex
+	ip      string
+	status  PeerStatus
+	removed bool
+}
+
+// peerStates is a map of peer IP addresses to their *peerState. Idle peers without
+// failures aren't kept
+var peerStates sync.Map
+
+// peerStateFor returns the state of the peer at ip, which starts out idle
+func peerStateFor(ip string) *peerState {
+	value, _ := peerStates.LoadOrStore(ip, &peerState{ip: ip, status: PeerStatus{State: PeerIdle}})
+	return value.(*peerState)
+}
+
+// lock locks the state of the peer and returns it. If the state was removed while it
+// was being used, the peer's current state is locked and returned instead
+func (p *peerState) lock() *peerState {
+	for {
+		p.mutex.Lock()
+		if !p.removed {
+			return p
+		}
+		p.mutex.Unlock()
+		p = peerStateFor(p.ip)
+	}
+}
+
+// removeIfIdle deletes the state of an idle peer without failures, since it's the
+// same as not having one. p must be locked
+func (p *peerState) removeIfIdle() {
+	if p.status.State == PeerIdle && p.status.Failures == 0 {
+		p.removed = true
+		peerStates.CompareAndDelete(p.ip, p)
+	}
+}
+
+// backoffDelay returns how long to wait after a number of failures in a row. The
+// delay is jittered between half and all of the exponential backoff, so peers that
+// failed together don't all retry together
+func backoffDelay(failures int) time.Duration {
+	delay := BackoffMin
+	for i := 1; i < failures && delay < BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > BackoffMax {
+		delay = BackoffMax
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// dialing moves a peer to connecting, returning false if it's backing off and
+// can't be dialed yet
+func (p *peerState) dialing() bool {
+	p = p.lock()
+	defer p.mutex.Unlock()
+	if p.status.State == PeerBackingOff && time.Now().Before(p.status.NextRetry) {
+		return false
+	}
+	if p.status.State != PeerUp {
+		p.status.State = PeerConnecting
+	}
+	return true
+}
+
+// connected moves a peer to up and forgets its failures
+func (p *peerState) connected() {
+	p = p.lock()
+	defer p.mutex.Unlock()
+	p.status = PeerStatus{State: PeerUp}
+}
+
+// failed moves a peer to backing-off after a failed dial, returning when it can be
+// dialed again. A peer that still has a link stays up
+func (p *peerState) failed() time.Time {
+	p = p.lock()
+	defer p.mutex.Unlock()
+	p.status.Failures++
+	p.status.NextRetry = time.Now().Add(backoffDelay(p.status.Failures))
+	if p.status.State != PeerUp {
+		p.status.State = PeerBackingOff
+	}
+	return p.status.NextRetry
+}
+
+// disconnected moves an up peer to idle once its last link is gone
+func (p *peerState) disconnected() {
+	p = p.lock()
+	defer p.mutex.Unlock()
+	if p.status.State == PeerUp {
+		p.status = PeerStatus{State: PeerIdle}
+	}
+	p.removeIfIdle()
+}
+
+// peerLinkClosed updates the state of the peer at ip after one of its links was
+// removed from the connection cache
+func peerLinkClosed(ip string) {
+	up := false
+	connMap.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), ip+"|") {
+			up = true
+		}
+		return !up
+	})
+	if !up {
+		peerStateFor(ip).disconnected()
+	}
+}
+
+// GetPeerState returns the connection state of the peer at an IP address
+func GetPeerState(ip string) PeerStatus {
+	value, ok := peerStates.Load(ip)
+	if !ok {
+		return PeerStatus{State: PeerIdle}
+	}
+	p := value.(*peerState)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
+
+// GetPeerStates returns the connection state of every peer that's connecting, up or
+// backing off, by IP address
+func GetPeerStates() map[string]PeerStatus {
+	states := make(map[string]PeerStatus)
+	peerStates.Range(func(key, value interface{}) bool {
+		p := value.(*peerState)
+		p.mutex.Lock()
+		states[key.(string)] = p.status
+		p.mutex.Unlock()
+		return true
+	})
+	return states
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	defer func(min, max time.Duration) { BackoffMin, BackoffMax = min, max }(BackoffMin, BackoffMax)
+	BackoffMin = time.Second
+	BackoffMax = 8 * time.Second
+	tests := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{30, 8 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay := backoffDelay(test.failures)
+			if delay < test.max/2 || delay > test.max {
+				t.Errorf("backoff after %d failures out of range. Got %s", test.failures, delay)
+			}
+		}
+	}
+}
+
+func TestPeerStateMachine(t *testing.T) {
+	mem, _ := useMemTransport(t, []PeerConf{{Address: "192.168.7.10", Transport: "mem"}})
+	defer peerStates.Delete("192.168.7.10")
+	header := UDPRxHeader{MajorVersion: 1, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.7.10")}
+	if status := GetPeerState("192.168.7.10"); status.State != PeerIdle {
+		t.Errorf("unknown peer should be idle. Got %s", status.State)
+	}
+	// nothing is listening, so the dial fails and the peer backs off
+	if _, err := getConn(header, &tls.Config{}, ":55554"); err == nil {
+		t.Fatal("dial should have failed")
+	}
+	status := GetPeerState("192.168.7.10")
+	if status.State != PeerBackingOff || status.Failures != 1 || !status.NextRetry.After(time.Now()) {
+		t.Errorf("wrong state after a failed dial. Got %+v", status)
+	}
+	ln, err := mem.Listen("192.168.7.10:55554", &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go conn.Read(make([]byte, 1))
+		}
+	}()
+	if _, err := getConn(header, &tls.Config{}, ":55554"); err == nil {
+		t.Fatal("peer shouldn't be dialed while it's backing off")
+	} else if _, ok := err.(*connTimeoutError); !ok {
+		t.Fatalf("wrong error while backing off. Got %v", err)
+	}
+	// once the retry time passes the peer is dialed again
+	peer := peerStateFor("192.168.7.10")
+	peer.mutex.Lock()
+	peer.status.NextRetry = time.Now()
+	peer.mutex.Unlock()
+	if _, err := getConn(header, &tls.Config{}, ":55554"); err != nil {
+		t.Fatal(err)
+	}
+	if status := GetPeerState("192.168.7.10"); status.State != PeerUp || status.Failures != 0 {
+		t.Errorf("wrong state after connecting. Got %+v", status)
+	}
+	removeConn(header)
+	if status := GetPeerState("192.168.7.10"); status.State != PeerIdle {
+		t.Errorf("peer without links should be idle. Got %s", status.State)
+	}
+	// idle peers aren't kept
+	if _, ok := GetPeerStates()["192.168.7.10"]; ok {
+		t.Error("idle peer should have been removed from the peer states")
+	}
+}
+
+func TestRemovedPeerState(t *testing.T) {
+	defer peerStates.Delete("192.168.7.12")
+	peer := peerStateFor("192.168.7.12")
+	peer.connected()
+	peer.disconnected()
+	if _, ok := peerStates.Load("192.168.7.12"); ok {
+		t.Fatal("idle peer should have been removed")
+	}
+	// a dial that finishes after the state was removed still updates the peer
+	peer.connected()
+	if status := GetPeerState("192.168.7.12"); status.State != PeerUp {
+		t.Errorf("connecting through a removed state should have updated the peer. Got %s", status.State)
+	}
+}
+
+func TestInboundLinkResetsBackoff(t *testing.T) {
+	defer peerStates.Delete("192.168.7.11")
+	defer removeConn(UDPRxHeader{DestIPAddr: net.ParseIP("192.168.7.11")})
+	peerStateFor("192.168.7.11").failed()
+	if status := GetPeerState("192.168.7.11"); status.State != PeerBackingOff {
+		t.Fatalf("peer should be backing off. Got %s", status.State)
+	}
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.7.11"), Port: 40000}
+	addConn("192.168.7.11", "127.0.0.1", &memLink{Conn: c, remote: remote, reader: bufio.NewReader(c), peer: "abcd"})
+	if status := GetPeerState("192.168.7.11"); status.State != PeerUp || status.Failures != 0 {
+		t.Errorf("inbound link should have reset the peer. Got %+v", status)
+	}
+}
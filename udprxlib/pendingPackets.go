@@ -0,0 +1,204 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// PendingDepth is the most packets that can wait for a connection to a single peer
+var PendingDepth = 256
+
+// PendingMaxAge is how long a packet can wait for a connection to its peer before
+// it's dropped. 0 drops packets for unreachable peers straight away
+var PendingMaxAge = 5 * time.Second
+
+// errPendingTimedOut is the result of a packet that was dropped after waiting too
+// long for its peer
+var errPendingTimedOut = errors.New("timed out waiting for a connection to the peer")
+
+// pendingPacket is a queued packet waiting for its peer, and when it started waiting
+type pendingPacket struct {
+	packet queuedPacket
+	added  time.Time
+}
+
+// pendingBuffer holds the packets for a peer that couldn't be connected to, in the
+// order they were sent. Once a packet is waiting, later packets to the peer wait
+// behind it so they can't overtake it. A buffer only exists while packets are waiting
+// or being flushed. A closed buffer has been removed from pendingBuffers
+type pendingBuffer struct {
+	mutex    sync.Mutex
+	ip       string
+	packets  []pendingPacket
+	flushing bool
+	closed   bool
+	timer    *time.Timer
+}
+
+// pendingBuffers is a map of peer IP addresses to *pendingBuffer
+var pendingBuffers = sync.Map{}
+
+// lockPendingBuffer returns the pending buffer for the peer at ip, locked. If the
+// peer has none, one is created if create is true and nil is returned if it isn't
+func lockPendingBuffer(ip string, create bool) *pendingBuffer {
+	for {
+		b, ok := pendingBuffers.Load(ip)
+		if !ok {
+			if !create {
+				return nil
+			}
+			b, _ = pendingBuffers.LoadOrStore(ip, &pendingBuffer{ip: ip})
+		}
+		buf := b.(*pendingBuffer)
+		buf.mutex.Lock()
+		// the buffer emptied and was removed after we found it
+		if !buf.closed {
+			return buf
+		}
+		buf.mutex.Unlock()
+	}
+}
+
+// forwardOrBuffer forwards a queued packet, or puts it in its peer's pending buffer
+// if the peer can't be reached or other packets are already waiting for it. It
+// returns true if the packet was buffered, and the result of the send if it wasn't
+func forwardOrBuffer(packet queuedPacket) (bool, error) {
+	if PendingMaxAge <= 0 {
+		return false, forwardPacketFunc(packet.conf, packet.header, packet.data, packet.srcport, packet.remoteTLSPort)
+	}
+	ip := packet.header.DestIPAddr.String()
+	if b := lockPendingBuffer(ip, false); b != nil {
+		if len(b.packets) > 0 || b.flushing {
+			b.add(packet, time.Now())
+			b.mutex.Unlock()
+			return true, nil
+		}
+		b.mutex.Unlock()
+	}
+	err := forwardPacketFunc(packet.conf, packet.header, packet.data, packet.srcport, packet.remoteTLSPort)
+	if _, ok := err.(*peerUnavailableError); !ok {
+		return false, err
+	}
+	b := lockPendingBuffer(ip, true)
+	b.add(packet, time.Now())
+	b.scheduleRetry()
+	b.mutex.Unlock()
+	return true, nil
+}
+
+// add appends a packet to the buffer, dropping the oldest one if it's full. The
+// buffer must be locked
+func (b *pendingBuffer) add(packet queuedPacket, added time.Time) {
+	if len(b.packets) >= PendingDepth {
+		dropped := b.packets[0]
+		b.packets[0] = pendingPacket{}
+		b.packets = b.packets[1:]
+		incCounter("pending_dropped")
+		if dropped.packet.done != nil {
+			dropped.packet.done(errQueueFull)
+		}
+	}
+	b.packets = append(b.packets, pendingPacket{packet, added})
+	incCounter("pending_buffered")
+}
+
+// expire drops the packets that have waited longer than PendingMaxAge. The buffer
+// must be locked
+func (b *pendingBuffer) expire(now time.Time) {
+	for len(b.packets) > 0 && now.Sub(b.packets[0].added) >= PendingMaxAge {
+		expired := b.packets[0]
+		b.packets[0] = pendingPacket{}
+		b.packets = b.packets[1:]
+		incCounter("pending_timed_out")
+		if expired.packet.done != nil {
+			expired.packet.done(errPendingTimedOut)
+		}
+	}
+}
+
+// scheduleRetry flushes the buffer again when the peer can next be dialed, or when
+// its oldest packet expires if that's sooner. The buffer must be locked
+func (b *pendingBuffer) scheduleRetry() {
+	if len(b.packets) == 0 {
+		return
+	}
+	next := GetPeerState(b.ip).NextRetry
+	if expires := b.packets[0].added.Add(PendingMaxAge); next.IsZero() || expires.Before(next) {
+		next = expires
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timer = time.AfterFunc(time.Until(next), b.flush)
+}
+
+// flushPending sends the packets waiting for the peer at ip, if there are any
+func flushPending(ip string) {
+	if b, ok := pendingBuffers.Load(ip); ok {
+		b.(*pendingBuffer).flush()
+	}
+}
+
+// flush sends the waiting packets in order until the buffer is empty, or the peer
+// can't be reached again and the rest wait for the next retry
+func (b *pendingBuffer) flush() {
+	b.mutex.Lock()
+	if b.flushing || b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	b.flushing = true
+	for {
+		b.expire(time.Now())
+		if len(b.packets) == 0 {
+			break
+		}
+		pending := b.packets[0]
+		b.packets[0] = pendingPacket{}
+		b.packets = b.packets[1:]
+		b.mutex.Unlock()
+		packet := pending.packet
+		err := forwardPacketFunc(packet.conf, packet.header, packet.data, packet.srcport, packet.remoteTLSPort)
+		if _, ok := err.(*peerUnavailableError); ok {
+			b.mutex.Lock()
+			b.packets = append([]pendingPacket{pending}, b.packets...)
+			b.scheduleRetry()
+			break
+		}
+		if err == nil {
+			incCounter("pending_sent")
+		}
+		finishPacket(packet, err)
+		b.mutex.Lock()
+	}
+	b.flushing = false
+	// packets to the peer go straight out again, so the buffer isn't needed
+	if len(b.packets) == 0 {
+		b.closed = true
+		pendingBuffers.CompareAndDelete(b.ip, b)
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+	}
+	b.mutex.Unlock()
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unreachablePeer mocks forwardPacket for a peer that can't be reached until up is
+// called, recording the packets sent after that
+type unreachablePeer struct {
+	mutex sync.Mutex
+	up    bool
+	sent  []byte
+}
+
+func (p *unreachablePeer) forward(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.up {
+		return &peerUnavailableError{errors.New("connection refused")}
+	}
+	p.sent = append(p.sent, data[0])
+	return nil
+}
+
+// pendingCount returns the number of packets in a peer's pending buffer
+func pendingCount(ip string) int {
+	b := lockPendingBuffer(ip, false)
+	if b == nil {
+		return 0
+	}
+	defer b.mutex.Unlock()
+	return len(b.packets)
+}
+
+// waitPending waits for a peer's pending buffer to hold count packets
+func waitPending(t *testing.T, ip string, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		waiting := pendingCount(ip)
+		if waiting == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong number of pending packets. Got %d, expected %d", waiting, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// cleanupPending stops retrying a peer's pending buffer and forgets it
+func cleanupPending(ip string) {
+	b := lockPendingBuffer(ip, false)
+	if b == nil {
+		return
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.closed = true
+	pendingBuffers.Delete(ip)
+	b.mutex.Unlock()
+}
+
+func TestPendingFlushInOrder(t *testing.T) {
+	defer func(age time.Duration) { PendingMaxAge = age }(PendingMaxAge)
+	PendingMaxAge = time.Minute
+	peer := &unreachablePeer{}
+	forwardPacketFunc = peer.forward
+	defer func() { forwardPacketFunc = forwardPacket }()
+	defer cleanupPending("192.168.5.20")
+	before := GetCounters()["pending_sent"]
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.5.20")}
+	for i := byte(0); i < 3; i++ {
+		enqueuePacket(&tls.Config{}, header, []byte{i}, 4000, RemoteTLSPort, nil)
+	}
+	waitPending(t, "192.168.5.20", 3)
+	peer.mutex.Lock()
+	peer.up = true
+	peer.mutex.Unlock()
+	flushPending("192.168.5.20")
+	// a packet sent after the flush goes straight out, behind the waiting ones
+	result := make(chan error, 1)
+	enqueuePacket(&tls.Config{}, header, []byte{3}, 4000, RemoteTLSPort, func(err error) { result <- err })
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	if string(peer.sent) != string([]byte{0, 1, 2, 3}) {
+		t.Errorf("wrong send order. Got %v", peer.sent)
+	}
+	if GetCounters()["pending_sent"] != before+3 {
+		t.Errorf("wrong pending sent count. Got %d", GetCounters()["pending_sent"]-before)
+	}
+	// the emptied buffer is removed, and packets that go straight out never make one
+	if _, ok := pendingBuffers.Load("192.168.5.20"); ok {
+		t.Error("empty pending buffer should have been removed")
+	}
+}
+
+func TestPendingTimeout(t *testing.T) {
+	defer func(age time.Duration) { PendingMaxAge = age }(PendingMaxAge)
+	PendingMaxAge = 50 * time.Millisecond
+	forwardPacketFunc = (&unreachablePeer{}).forward
+	defer func() { forwardPacketFunc = forwardPacket }()
+	defer cleanupPending("192.168.5.21")
+	before := GetCounters()["pending_timed_out"]
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.5.21")}
+	result := make(chan error, 1)
+	enqueuePacket(&tls.Config{}, header, []byte{0}, 4000, RemoteTLSPort, func(err error) { result <- err })
+	select {
+	case err := <-result:
+		if err != errPendingTimedOut {
+			t.Errorf("wrong result for an expired packet. Got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending packet didn't expire")
+	}
+	if GetCounters()["pending_timed_out"] != before+1 {
+		t.Error("expired packet wasn't counted")
+	}
+	// the buffer is removed once its last packet has expired
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := pendingBuffers.Load("192.168.5.21"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired pending buffer wasn't removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPendingDepth(t *testing.T) {
+	defer func(depth int, age time.Duration) { PendingDepth, PendingMaxAge = depth, age }(PendingDepth, PendingMaxAge)
+	PendingDepth, PendingMaxAge = 2, time.Minute
+	forwardPacketFunc = (&unreachablePeer{}).forward
+	defer func() { forwardPacketFunc = forwardPacket }()
+	defer cleanupPending("192.168.5.22")
+	before := GetCounters()["pending_dropped"]
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.5.22")}
+	result := make(chan error, 1)
+	enqueuePacket(&tls.Config{}, header, []byte{0}, 4000, RemoteTLSPort, func(err error) { result <- err })
+	for i := byte(1); i < 3; i++ {
+		enqueuePacket(&tls.Config{}, header, []byte{i}, 4000, RemoteTLSPort, nil)
+	}
+	select {
+	case err := <-result:
+		if err != errQueueFull {
+			t.Errorf("wrong result for a dropped packet. Got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("oldest pending packet wasn't dropped")
+	}
+	waitPending(t, "192.168.5.22", 2)
+	if GetCounters()["pending_dropped"] != before+1 {
+		t.Error("dropped packet wasn't counted")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// relayFilterTTL is how long a re-emitted packet is remembered for. It only has to
+// cover the time for the packet to loop back to one of our own listeners
+var relayFilterTTL = 2 * time.Second
+
+// relayedPackets is a map of relay keys to the time they were re-emitted. Packets
+// that udp_rx puts on the local network for a remote sender are remembered here so our
+// own listeners don't capture them and send them straight back
+var relayedPackets = make(map[string]time.Time)
+var relayedPacketsMutex = &sync.Mutex{}
+var lastRelaySweep time.Time
+
+// relayKey identifies a re-emitted packet by its addressing and a hash of its payload
+func relayKey(srcip string, srcport uint, destip string, destport uint, data []byte) string {
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf("%s:%d|%s:%d|%x", srcip, srcport, destip, destport, h.Sum64())
+}
+
+// rememberRelayed records that a packet was re-emitted on the local network
+func rememberRelayed(key string) {
+	relayedPacketsMutex.Lock()
+	defer relayedPacketsMutex.Unlock()
+	now := time.Now()
+	relayedPackets[key] = now
+	// drop anything that's expired so the map doesn't grow without bound
+	if now.Sub(lastRelaySweep) > relayFilterTTL {
+		for k, v := range relayedPackets {
+			if now.Sub(v) > relayFilterTTL {
+				delete(relayedPackets, k)
+			}
+		}
+		lastRelaySweep = now
+	}
+}
+
+// wasRelayed returns true if a captured packet is one we re-emitted ourselves
+func wasRelayed(key string) bool {
+	relayedPacketsMutex.Lock()
+	defer relayedPacketsMutex.Unlock()
+	emitted, ok := relayedPackets[key]
+	return ok && time.Since(emitted) <= relayFilterTTL
+}
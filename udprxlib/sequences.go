@@ -0,0 +1,222 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StrictOrderPorts are the destination ports whose flows are delivered strictly in
+// order. Duplicate and out of order packets for them are dropped instead of delivered
+var StrictOrderPorts []int
+
+// seqWindow is how many sequence numbers behind the newest a packet can be and still
+// be told apart as reordered or duplicated
+const seqWindow = 64
+
+// seqResetDistance is how far a sequence number has to jump from the newest, forwards
+// or backwards, before it's taken as the sender starting the flow over at a new random
+// number, rather than loss or a very late packet
+const seqResetDistance = 1 << 16
+
+// seqFlowIdleTimeout is how long a flow's sequence state is kept without traffic
+var seqFlowIdleTimeout = 5 * time.Minute
+
+// sequence number checks on a received packet
+const (
+	seqInOrder = iota
+	seqGap
+	seqReordered
+	seqDuplicate
+	seqLate
+	seqReset
+)
+
+// sendFlow is the next sequence number for a flow we send
+type sendFlow struct {
+	next     uint32
+	lastUsed time.Time
+}
+
+// recvFlow is what we've seen of a flow we receive. Bit i of seen is set if the
+// packet i before highest has arrived
+type recvFlow struct {
+	highest  uint32
+	seen     uint64
+	lastUsed time.Time
+}
+
+var sendFlows = make(map[string]*sendFlow)
+var recvFlows = make(map[string]*recvFlow)
+var flowsMutex = &sync.Mutex{}
+var lastFlowSweep time.Time
+
+// flowKey identifies a flow by the link's addresses and the datagram's ports. The
+// link's ephemeral TCP port is left out so a flow survives reconnects
+func flowKey(fromIP string, toIP string, srcport uint, destport uint) string {
+	return fmt.Sprintf("%s:%d|%s:%d", fromIP, srcport, toIP, destport)
+}
+
+// addrIP returns the IP address of a net.Addr as a string
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// nextSequence returns the sequence number for the next packet of a flow sent on conn
+func nextSequence(conn net.Conn, srcport uint, destport uint) uint32 {
+	flowsMutex.Lock()
+	defer flowsMutex.Unlock()
+	now := time.Now()
+	sweepFlows(now)
+	key := flowKey(addrIP(conn.LocalAddr()), addrIP(conn.RemoteAddr()), srcport, destport)
+	flow, ok := sendFlows[key]
+	if !ok {
+		// a random start keeps a restarted flow from landing in the receiver's window
+		flow = &sendFlow{next: rand.Uint32()}
+		sendFlows[key] = flow
+	}
+	flow.lastUsed = now
+	seq := flow.next
+	flow.next++
+	return seq
+}
+
+// checkSequence records a packet's sequence number on a flow received on conn, and
+// returns what it says about the flow along with the number of packets skipped over
+func checkSequence(conn net.Conn, srcport uint, destport uint, seq uint32) (int, uint32) {
+	flowsMutex.Lock()
+	defer flowsMutex.Unlock()
+	now := time.Now()
+	sweepFlows(now)
+	key := flowKey(addrIP(conn.RemoteAddr()), addrIP(conn.LocalAddr()), srcport, destport)
+	flow, ok := recvFlows[key]
+	if !ok {
+		recvFlows[key] = &recvFlow{highest: seq, seen: 1, lastUsed: now}
+		return seqInOrder, 0
+	}
+	flow.lastUsed = now
+	// serial number arithmetic, so the flow can wrap
+	distance := int64(int32(seq - flow.highest))
+	switch {
+	case distance >= seqResetDistance || -distance >= seqResetDistance:
+		flow.highest = seq
+		flow.seen = 1
+		return seqReset, 0
+	case distance > 0:
+		if distance >= seqWindow {
+			flow.seen = 0
+		} else {
+			flow.seen <<= uint(distance)
+		}
+		flow.seen |= 1
+		flow.highest = seq
+		if distance > 1 {
+			return seqGap, uint32(distance - 1)
+		}
+		return seqInOrder, 0
+	case -distance >= seqWindow:
+		return seqLate, 0
+	}
+	bit := uint64(1) << uint(-distance)
+	if flow.seen&bit != 0 {
+		return seqDuplicate, 0
+	}
+	flow.seen |= bit
+	return seqReordered, 0
+}
+
+// sweepFlows drops idle flows so the flow tables don't grow without bound. Callers
+// hold flowsMutex
+func sweepFlows(now time.Time) {
+	if now.Sub(lastFlowSweep) < seqFlowIdleTimeout {
+		return
+	}
+	for k, flow := range sendFlows {
+		if now.Sub(flow.lastUsed) > seqFlowIdleTimeout {
+			delete(sendFlows, k)
+		}
+	}
+	for k, flow := range recvFlows {
+		if now.Sub(flow.lastUsed) > seqFlowIdleTimeout {
+			delete(recvFlows, k)
+		}
+	}
+	lastFlowSweep = now
+}
+
+// isStrictOrder returns true if packets to destport must be delivered in order
+func isStrictOrder(destport uint) bool {
+	for _, port := range StrictOrderPorts {
+		if uint(port) == destport {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptSequence counts and logs loss, reordering and duplication on a flow, and
+// returns false if the packet should be dropped
+func acceptSequence(conn net.Conn, srcport uint, destport uint, seq uint32) bool {
+	result, missing := checkSequence(conn, srcport, destport, seq)
+	fields := log.Fields{
+		"remote":   conn.RemoteAddr().String(),
+		"srcport":  srcport,
+		"destport": destport,
+		"sequence": seq,
+	}
+	switch result {
+	case seqInOrder:
+		return true
+	case seqGap:
+		incCounter("seq_gaps")
+		addCounter("seq_missing", uint64(missing))
+		fields["missing"] = missing
+		log.WithFields(fields).Info("Gap in flow sequence numbers")
+		return true
+	case seqReset:
+		incCounter("seq_resets")
+		log.WithFields(fields).Info("Flow sequence numbers started over")
+		return true
+	case seqReordered:
+		incCounter("seq_reordered")
+		log.WithFields(fields).Info("Packet arrived out of order")
+	case seqLate:
+		incCounter("seq_late")
+		log.WithFields(fields).Info("Packet arrived too late to be ordered")
+	case seqDuplicate:
+		incCounter("seq_duplicates")
+		log.WithFields(fields).Info("Duplicate packet")
+	}
+	if isStrictOrder(destport) {
+		incCounter("seq_strict_dropped")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"net"
+	"testing"
+)
+
+// resetFlows forgets every flow, so a test starts from nothing
+func resetFlows() {
+	flowsMutex.Lock()
+	sendFlows = make(map[string]*sendFlow)
+	recvFlows = make(map[string]*recvFlow)
+	flowsMutex.Unlock()
+}
+
+func TestNextSequence(t *testing.T) {
+	resetFlows()
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	first := nextSequence(c, 4000, 51000)
+	if nextSequence(c, 4000, 51000) != first+1 || nextSequence(c, 4000, 51000) != first+2 {
+		t.Error("sequence numbers should count up on a flow")
+	}
+}
+
+func TestCheckSequence(t *testing.T) {
+	resetFlows()
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	// start near the top so the flow wraps
+	start := uint32(0xFFFFFFFE)
+	checks := []struct {
+		seq     uint32
+		result  int
+		missing uint32
+	}{
+		{start, seqInOrder, 0},
+		{start + 1, seqInOrder, 0},
+		{start + 4, seqGap, 2},
+		{start + 2, seqReordered, 0},
+		{start + 2, seqDuplicate, 0},
+		{start + 4, seqDuplicate, 0},
+		{start + 5, seqInOrder, 0},
+		{start + 200, seqGap, 194},
+		{start + 3, seqLate, 0},
+		{start + 199 + seqResetDistance, seqGap, seqResetDistance - 2},
+		// a restarted sender picks a new random start, ahead or behind
+		{start, seqReset, 0},
+		{start + 1, seqInOrder, 0},
+		{start + 1 + seqResetDistance, seqReset, 0},
+		{start + 2 + seqResetDistance, seqInOrder, 0},
+		{start + 2 + seqResetDistance + 1<<31, seqReset, 0},
+	}
+	for i, check := range checks {
+		result, missing := checkSequence(s, 4000, 51001, check.seq)
+		if result != check.result || missing != check.missing {
+			t.Errorf("check %d: wrong result for sequence %d. Got %d with %d missing, expected %d with %d missing",
+				i, check.seq, result, missing, check.result, check.missing)
+		}
+	}
+}
+
+func TestAcceptSequenceStrictOrder(t *testing.T) {
+	resetFlows()
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	defer func() { StrictOrderPorts = nil }()
+	StrictOrderPorts = []int{51003}
+	before := GetCounters()["seq_strict_dropped"]
+	for _, destport := range []uint{51002, 51003} {
+		if !acceptSequence(s, 4000, destport, 10) || !acceptSequence(s, 4000, destport, 12) {
+			t.Errorf("in order packets for port %d should have been accepted", destport)
+		}
+		// 11 is out of order and 12 is a duplicate
+		accepted := acceptSequence(s, 4000, destport, 11) && acceptSequence(s, 4000, destport, 12)
+		if accepted != (destport == 51002) {
+			t.Errorf("wrong result for out of order packets to port %d. Got %v", destport, accepted)
+		}
+	}
+	if GetCounters()["seq_strict_dropped"] != before+1 {
+		t.Errorf("wrong strict order drop count. Got %d", GetCounters()["seq_strict_dropped"]-before)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionTicketRotation is how often the keys that encrypt TLS session tickets are
+// replaced
+var SessionTicketRotation = time.Hour
+
+// sessionTicketKeyCount is the number of ticket keys kept, so tickets issued just
+// before a rotation can still be resumed after it
+const sessionTicketKeyCount = 2
+
+// stopSessionTickets stops the key rotation of the last server config. Only one server
+// config is in use at a time, so starting a new rotation stops the old one
+var stopSessionTickets chan bool
+var sessionTicketsMutex = &sync.Mutex{}
+
+// rotateSessionTicketKeys puts a new random ticket key first on a server config and
+// returns the keys in use, dropping the oldest one
+func rotateSessionTicketKeys(conf *tls.Config, keys [][32]byte) ([][32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return keys, err
+	}
+	keys = append([][32]byte{key}, keys...)
+	if len(keys) > sessionTicketKeyCount {
+		keys = keys[:sessionTicketKeyCount]
+	}
+	conf.SetSessionTicketKeys(keys)
+	return keys, nil
+}
+
+// startSessionTicketRotation sets the ticket keys of a server config and replaces
+// them every SessionTicketRotation, until the rotation of a newer config starts
+func startSessionTicketRotation(conf *tls.Config) {
+	keys, err := rotateSessionTicketKeys(conf, nil)
+	if err != nil {
+		log.WithField("error", err).Error("Couldn't create a session ticket key")
+	}
+	sessionTicketsMutex.Lock()
+	defer sessionTicketsMutex.Unlock()
+	if stopSessionTickets != nil {
+		close(stopSessionTickets)
+	}
+	stop := make(chan bool)
+	stopSessionTickets = stop
+	ticker := time.NewTicker(SessionTicketRotation)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				keys, err = rotateSessionTicketKeys(conf, keys)
+				if err != nil {
+					log.WithField("error", err).Error("Couldn't rotate the session ticket keys")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// countHandshake counts a completed TLS handshake as resumed or full
+func countHandshake(state tls.ConnectionState) {
+	if state.DidResume {
+		incCounter("tls_handshakes_resumed")
+	} else {
+		incCounter("tls_handshakes_full")
+	}
+}
+
+// getConnectionVerifier is a closure which checks every connection from a client,
+// including those that resume a session and so skip VerifyPeerCertificate. A resumed
+// session's certificate was verified when it was issued, but the client has to be
+// connecting from an IP address that it's valid for
+func getConnectionVerifier(helloInfo *tls.ClientHelloInfo) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if state.DidResume {
+			remoteIP := strings.Split(helloInfo.Conn.RemoteAddr().String(), ":")[0]
+			err := errors.New("resumed session has no client certificate")
+			if len(state.PeerCertificates) > 0 {
+				err = state.PeerCertificates[0].VerifyHostname(remoteIP)
+			}
+			if err != nil {
+				incCounter("tls_resume_refused")
+				log.WithFields(log.Fields{
+					"error":  err,
+					"remote": remoteIP,
+				}).Error("Refusing resumed session")
+				return err
+			}
+		}
+		countHandshake(state)
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	conf := &tls.Config{}
+	var keys [][32]byte
+	var first [32]byte
+	for i := 0; i < 3; i++ {
+		var err error
+		keys, err = rotateSessionTicketKeys(conf, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = keys[0]
+		}
+	}
+	if len(keys) != sessionTicketKeyCount {
+		t.Errorf("wrong number of ticket keys. Got %d", len(keys))
+	}
+	if keys[0] == keys[1] || keys[0] == first || keys[1] == first {
+		t.Error("rotation should have replaced the oldest key with a new one")
+	}
+}
+
+func TestSessionTicketRotationRestart(t *testing.T) {
+	startSessionTicketRotation(&tls.Config{})
+	sessionTicketsMutex.Lock()
+	first := stopSessionTickets
+	sessionTicketsMutex.Unlock()
+	// a new server config stops the old config's rotation
+	startSessionTicketRotation(&tls.Config{})
+	select {
+	case <-first:
+	default:
+		t.Error("starting a new rotation should have stopped the old one")
+	}
+}
+
+// dialTLS connects to a TLS server from localIP and reads a byte, so the session
+// ticket the server sent is stored
+func dialTLS(t *testing.T, address string, localIP string, conf *tls.Config) (tls.ConnectionState, error) {
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, conf)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	return conn.ConnectionState(), err
+}
+
+func TestSessionResumption(t *testing.T) {
+	modifyKeyPathsWindows()
+	rootCAs := ConfigureRootCAs(&cacertpath)
+	cer, err := tls.LoadX509KeyPair(certpath, keypath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", GetServerConfig(rootCAs, &cer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.Write([]byte{1})
+				conn.Read(make([]byte, 1))
+			}(conn)
+		}
+	}()
+	clientConf := &tls.Config{
+		RootCAs:            rootCAs,
+		Certificates:       []tls.Certificate{cer},
+		ServerName:         "127.0.0.1",
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	before := GetCounters()
+	state, err := dialTLS(t, ln.Addr().String(), "127.0.0.1", clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.DidResume {
+		t.Error("first connection shouldn't have resumed a session")
+	}
+	state, err = dialTLS(t, ln.Addr().String(), "127.0.0.1", clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.DidResume {
+		t.Error("second connection should have resumed the session")
+	}
+	after := GetCounters()
+	if after["tls_handshakes_full"] != before["tls_handshakes_full"]+1 || after["tls_handshakes_resumed"] != before["tls_handshakes_resumed"]+1 {
+		t.Errorf("wrong handshake counts. Got %d full and %d resumed", after["tls_handshakes_full"]-before["tls_handshakes_full"],
+			after["tls_handshakes_resumed"]-before["tls_handshakes_resumed"])
+	}
+	// a session resumed from an address the certificate isn't valid for is refused
+	if runtime.GOOS != "linux" {
+		t.Skip("only linux routes all of 127.0.0.0/8 to loopback")
+	}
+	if _, err := dialTLS(t, ln.Addr().String(), "127.0.0.2", clientConf); err == nil {
+		t.Error("resumed session from another address should have been refused")
+	}
+	if GetCounters()["tls_resume_refused"] != before["tls_resume_refused"]+1 {
+		t.Error("refused resumption wasn't counted")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplySessions turns on the reply path. Every packet delivered from a peer opens a
+// session, and replies from the local application are tunneled back to the sender
+// without needing a header. Linux only, it needs the transparent listener
+var ReplySessions = false
+
+// SessionMark is the socket mark put on delivered packets when ReplySessions is on, so
+// the firewall can route the replies to the transparent listener
+const SessionMark = 0x2
+
+// SessionIdleTimeout is how long a session lasts without any traffic either way
+var SessionIdleTimeout = 60 * time.Second
+
+// replySession is a delivered flow from remoteIP:srcport to localIP:destport and the
+// link it arrived on, which replies are sent back over
+type replySession struct {
+	conn     net.Conn
+	remoteIP string
+	srcport  uint
+	localIP  string
+	destport uint
+	lastUsed time.Time
+}
+
+// sessions is a map of sessionKey strings to *replySession
+var sessions = make(map[string]*replySession)
+var sessionsMutex = &sync.Mutex{}
+var lastSessionSweep time.Time
+
+// sessionKey is the UDP 5-tuple of a session, from the local application's side
+func sessionKey(localIP string, localPort uint, remoteIP string, remotePort uint) string {
+	return fmt.Sprintf("udp|%s:%d|%s:%d", localIP, localPort, remoteIP, remotePort)
+}
+
+// recordSession opens or refreshes the session for a packet delivered from a peer
+func recordSession(conn net.Conn, remoteIP string, localIP string, srcport uint, destport uint) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	now := time.Now()
+	key := sessionKey(localIP, destport, remoteIP, srcport)
+	if s, ok := sessions[key]; ok && s.conn == conn {
+		s.lastUsed = now
+	} else {
+		incCounter("sessions_created")
+		sessions[key] = &replySession{
+			conn:     conn,
+			remoteIP: remoteIP,
+			srcport:  srcport,
+			localIP:  localIP,
+			destport: destport,
+			lastUsed: now,
+		}
+	}
+	// drop idle sessions so the table doesn't grow without bound
+	if now.Sub(lastSessionSweep) > SessionIdleTimeout {
+		for k, s := range sessions {
+			if now.Sub(s.lastUsed) > SessionIdleTimeout {
+				delete(sessions, k)
+			}
+		}
+		lastSessionSweep = now
+	}
+}
+
+// findSession returns the live session a reply from localIP:localPort to
+// remoteIP:remotePort belongs to, or nil. Finding a session refreshes it
+func findSession(localIP string, localPort uint, remoteIP string, remotePort uint) *replySession {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	key := sessionKey(localIP, localPort, remoteIP, remotePort)
+	s, ok := sessions[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(s.lastUsed) > SessionIdleTimeout {
+		delete(sessions, key)
+		return nil
+	}
+	s.lastUsed = time.Now()
+	return s
+}
+
+// removeSession drops a session whose link has gone away
+func removeSession(s *replySession) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	key := sessionKey(s.localIP, s.destport, s.remoteIP, s.srcport)
+	if sessions[key] == s {
+		delete(sessions, key)
+	}
+}
+
+// sendReply tunnels a reply from the local application back over the link the
+// session's packets arrived on
+func sendReply(s *replySession, data []byte) error {
+	if len(data) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is larger than the max of %d", len(data), MaxDatagramSize)
+	}
+	// the reply goes from the local application's port back to the sender's port
+	var frame []byte
+	if linkProtocol(s.conn) == linkProtocolV2 {
+		frame = encodeLinkDataFrame(s.conn, int(s.destport), int(s.srcport), nextSequence(s.conn, s.destport, s.srcport), nil, nil, data)
+	} else {
+		frame = encodeLegacyFrame(int(s.destport), int(s.srcport), data)
+	}
+	if max := asLink(s.conn).MaxWrite(); max > 0 && len(frame) > max {
+		incCounter("session_reply_failed")
+		return fmt.Errorf("reply of %d bytes is too large for the link to %s", len(data), s.remoteIP)
+	}
+	// replies are batched with the rest of the link's traffic
+	_, err := writeLink(s.conn, frame)
+	if err != nil {
+		incCounter("session_reply_failed")
+		removeSession(s)
+		log.WithFields(
+			log.Fields{
+				"error":    err,
+				"remoteIP": s.remoteIP,
+				"srcport":  s.srcport,
+				"destport": s.destport,
+			}).Error("Error sending reply to peer")
+		return err
+	}
+	incCounter("session_replies")
+	return nil
+}
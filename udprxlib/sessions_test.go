@@ -0,0 +1,96 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplySessions(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	recordSession(server, "192.168.2.50", "192.168.1.10", 4000, 50300)
+	defer func() { sessions = make(map[string]*replySession) }()
+	if findSession("192.168.1.10", 50300, "192.168.2.50", 4001) != nil {
+		t.Error("reply to a different port shouldn't match the session")
+	}
+	s := findSession("192.168.1.10", 50300, "192.168.2.50", 4000)
+	if s == nil {
+		t.Fatal("reply should have matched the session")
+	}
+	// the pipe isn't TLS, so the reply uses the legacy framing
+	go sendReply(s, []byte{1, 2, 3})
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame := make([]byte, 9)
+	_, err := bufio.NewReader(client).Read(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// length 3, from the application's port 50300 back to the sender's port 4000
+	if !bytes.Equal(frame, []byte{0x00, 0x03, 0xC4, 0x7C, 0x0F, 0xA0, 1, 2, 3}) {
+		t.Errorf("wrong reply frame. Got %v", frame)
+	}
+}
+
+func TestReplySessionIdle(t *testing.T) {
+	oldTimeout := SessionIdleTimeout
+	SessionIdleTimeout = 10 * time.Millisecond
+	defer func() { SessionIdleTimeout = oldTimeout }()
+	defer func() { sessions = make(map[string]*replySession) }()
+	recordSession(nil, "192.168.2.50", "192.168.1.10", 4000, 50300)
+	time.Sleep(20 * time.Millisecond)
+	if findSession("192.168.1.10", 50300, "192.168.2.50", 4000) != nil {
+		t.Error("idle session should have expired")
+	}
+}
+
+func TestReplyThroughLink(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	defer func() { sessions = make(map[string]*replySession) }()
+	// a reply too big for the link is refused without writing anything
+	link := &memLink{Conn: server, maxWrite: 8}
+	recordSession(link, "192.168.2.50", "192.168.1.10", 4000, 50300)
+	s := findSession("192.168.1.10", 50300, "192.168.2.50", 4000)
+	if s == nil {
+		t.Fatal("reply should have matched the session")
+	}
+	if err := sendReply(s, []byte{1, 2, 3}); err == nil {
+		t.Error("reply larger than the link's max write should have failed")
+	}
+	// with batching on, replies are batched with the link's other frames
+	oldDelay := BatchDelay
+	BatchDelay = time.Hour
+	defer func() { BatchDelay = oldDelay }()
+	link.maxWrite = 0
+	defer dropLink(link)
+	if err := sendReply(s, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := batchWriters.Load(link); !ok {
+		t.Error("reply should have gone through the link's batch writer")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StaticTunnel is a header-less tunnel from a local UDP port to a fixed remote
+// destination, for devices that can't prepend the udp_rx header
+type StaticTunnel struct {
+	// ListenPort is the local UDP port to accept plain datagrams on
+	ListenPort int `json:"listenPort"`
+	// Remote is the IP address or hostname of the remote udp_rx peer
+	Remote string `json:"remote"`
+	// DestPort is the UDP port the remote udp_rx delivers to
+	DestPort int `json:"destPort"`
+	// SourceIP optionally forces the local IP address used to connect to the peer
+	SourceIP string `json:"sourceIP"`
+}
+
+// staticTunnelListeners is a map of listen ports to the *net.UDPConn listening on them
+var staticTunnelListeners = sync.Map{}
+
+// header builds the UDPRxHeader that every datagram on the tunnel is sent with
+func (tunnel StaticTunnel) header() (UDPRxHeader, error) {
+	header := UDPRxHeader{MajorVersion: 2, PortNumber: tunnel.DestPort}
+	if tunnel.ListenPort <= 0 || tunnel.ListenPort > 0xFFFF {
+		return UDPRxHeader{}, errors.New("invalid static tunnel listen port")
+	}
+	if tunnel.DestPort <= 0 || tunnel.DestPort > 0xFFFF || tunnel.DestPort == 1023 {
+		return UDPRxHeader{}, errors.New("invalid static tunnel destination port")
+	}
+	if tunnel.Remote == "" {
+		return UDPRxHeader{}, errors.New("static tunnel has no remote")
+	}
+	if ip := net.ParseIP(tunnel.Remote); ip != nil {
+		header.DestIPAddr = ip
+	} else {
+		header.DestHostname = tunnel.Remote
+	}
+	if tunnel.SourceIP != "" {
+		header.SourceIPAddr = net.ParseIP(tunnel.SourceIP)
+		if header.SourceIPAddr == nil {
+			return UDPRxHeader{}, errors.New("invalid static tunnel source IP")
+		}
+	}
+	return header, nil
+}
+
+// StaticTunnelListener listens for plain datagrams on a static tunnel's port and forwards
+// them to the tunnel's remote the same way as packets with a udp_rx header
+func StaticTunnelListener(listenAddrFlag *string, tunnel StaticTunnel, clientConf *tls.Config, done chan error) {
+	header, err := tunnel.header()
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error":  err,
+				"tunnel": tunnel,
+			}).Error("Invalid static tunnel configuration")
+		done <- err
+		return
+	}
+	listenAddr := fmt.Sprintf("%s:%d", *listenAddrFlag, tunnel.ListenPort)
+	ServerAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error": err,
+			}).Error("Couldn't bind static tunnel socket")
+		done <- err
+		return
+	}
+	ServerConn, err := net.ListenUDP("udp", ServerAddr)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error": err,
+				"port":  tunnel.ListenPort,
+			}).Error("Couldn't Listen to UDP for static tunnel")
+		done <- err
+		return
+	}
+	staticTunnelListeners.Store(tunnel.ListenPort, ServerConn)
+	defer ServerConn.Close()
+
+	log.WithFields(log.Fields{
+		"port":     tunnel.ListenPort,
+		"remote":   tunnel.Remote,
+		"destport": tunnel.DestPort,
+	}).Info("Ready to accept static tunnel datagrams...")
+	readbuf := make([]byte, maxUDPReadSize)
+	for {
+		n, src, err := ServerConn.ReadFromUDP(readbuf)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error": err,
+					"port":  tunnel.ListenPort,
+				}).Error("Error reading from static tunnel port. Terminating tunnel thread.")
+			done <- err
+			return
+		}
+		if n > MaxDatagramSize {
+			incCounter("ingress_oversized")
+			log.WithFields(
+				log.Fields{
+					"length": n,
+					"max":    MaxDatagramSize,
+				}).Error("Datagram larger than the max datagram size, dropping.")
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, readbuf[:n])
+		dispatchPacket(clientConf, header, data, src.IP, src.Port)
+	}
+}
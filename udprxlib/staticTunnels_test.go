@@ -0,0 +1,88 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+package udprxlib
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStaticTunnelHeader(t *testing.T) {
+	tunnel := StaticTunnel{ListenPort: 4000, Remote: "192.168.1.50", DestPort: 4001, SourceIP: "192.168.1.2"}
+	header, err := tunnel.header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.DestIPAddr.String() != "192.168.1.50" || header.PortNumber != 4001 {
+		t.Errorf("wrong destination. Got %s:%d", header.DestIPAddr.String(), header.PortNumber)
+	}
+	if header.SourceIPAddr.String() != "192.168.1.2" {
+		t.Errorf("wrong source ip. Got %s", header.SourceIPAddr.String())
+	}
+	tunnel.Remote = "controller1.example"
+	header, err = tunnel.header()
+	if err != nil || header.DestHostname != "controller1.example" {
+		t.Error("hostname remote should be resolved later")
+	}
+	tunnel.DestPort = 1023
+	if _, err = tunnel.header(); err == nil {
+		t.Error("reserved dest port should be rejected")
+	}
+}
+
+func TestStaticTunnelListener(t *testing.T) {
+	type forwarded struct {
+		header UDPRxHeader
+		data   []byte
+	}
+	received := make(chan forwarded, 1)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		received <- forwarded{header, data}
+		return nil
+	}
+	defer func() { forwardPacketFunc = forwardPacket }()
+	listenAddr := "127.0.0.1"
+	tunnel := StaticTunnel{ListenPort: 55560, Remote: "192.168.1.50", DestPort: 4001}
+	doneChan := make(chan error, 1)
+	go StaticTunnelListener(&listenAddr, tunnel, &tls.Config{}, doneChan)
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("udp", "127.0.0.1:55560")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, 4, 3})
+	select {
+	case f := <-received:
+		if f.header.DestIPAddr.String() != "192.168.1.50" || f.header.PortNumber != 4001 {
+			t.Errorf("wrong destination. Got %s:%d", f.header.DestIPAddr.String(), f.header.PortNumber)
+		}
+		if len(f.data) != 3 || f.data[0] != 5 {
+			t.Errorf("wrong data. Got %v", f.data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("datagram was not forwarded")
+	}
+	ln, _ := staticTunnelListeners.Load(55560)
+	ln.(*net.UDPConn).Close()
+	if err = <-doneChan; err == nil {
+		t.Error("Should have gotten an error")
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stream ingress reply statuses, one is sent back for every frame
+const (
+	// streamStatusQueued means the packet was queued for the peer, or delivered locally
+	streamStatusQueued = 0x00
+	// streamStatusUnreachable means the peer (or one of the fan-out peers) is backing off
+	// after failed dials, or couldn't be resolved
+	streamStatusUnreachable = 0x01
+	// streamStatusRejected means the frame was malformed or not allowed
+	streamStatusRejected = 0x02
+)
+
+// errPeerBackingOff is the result of a stream frame for a peer that's backing off
+var errPeerBackingOff = errors.New("peer is backing off after failed dials")
+
+// StreamSocketMode is the file mode the unix stream socket is created with. The socket's
+// owner, group and mode control which local users may send
+var StreamSocketMode os.FileMode = 0660
+
+// streamListeners is a map of stream listen addresses to the net.Listener on them
+var streamListeners = sync.Map{}
+
+// StreamListener accepts length-prefixed frames from local applications over a stream
+// socket. network is "unix" for a unix domain socket at the path address, or "tcp" for
+// a loopback TCP address. Every frame gets a one byte status reply
+func StreamListener(network string, address string, clientConf *tls.Config, done chan error) {
+	if network == "unix" {
+		// a socket file left over from a previous run stops us from binding
+		if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error":   err,
+				"network": network,
+				"address": address,
+			}).Error("Couldn't listen for stream ingress")
+		done <- err
+		return
+	}
+	if network == "unix" {
+		err = os.Chmod(address, StreamSocketMode)
+		if err != nil {
+			ln.Close()
+			log.WithFields(
+				log.Fields{
+					"error":   err,
+					"address": address,
+				}).Error("Couldn't set stream socket permissions")
+			done <- err
+			return
+		}
+	}
+	streamListeners.Store(address, ln)
+	defer ln.Close()
+
+	log.WithFields(log.Fields{
+		"network": network,
+		"address": address,
+	}).Info("Ready to accept stream connections...")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error":   err,
+					"address": address,
+				}).Error("Error accepting stream connection. Terminating stream thread.")
+			done <- err
+			return
+		}
+		go handleStreamConn(conn, clientConf)
+	}
+}
+
+// handleStreamConn reads frames from a local stream connection until it's closed. A
+// frame is a 2 byte big endian length followed by a udp_rx header and payload, the same
+// as a datagram sent to the ingress port
+func handleStreamConn(conn net.Conn, clientConf *tls.Config) {
+	defer conn.Close()
+	// unix sockets have no address, so their packets look like they came from localhost.
+	// Only TCP senders go through the ingress rules, the socket permissions cover the rest
+	srcIP := net.IPv4(127, 0, 0, 1)
+	srcport := UDPListenPort
+	tcpAddr, isTCP := conn.RemoteAddr().(*net.TCPAddr)
+	if isTCP {
+		srcIP = tcpAddr.IP
+		srcport = tcpAddr.Port
+	}
+	lenbuf := make([]byte, 2)
+	for {
+		_, err := io.ReadFull(conn, lenbuf)
+		if err != nil {
+			if err != io.EOF {
+				log.WithFields(
+					log.Fields{
+						"error": err,
+					}).Error("Error reading stream frame length")
+			}
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(lenbuf))
+		_, err = io.ReadFull(conn, frame)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error": err,
+				}).Error("Error reading stream frame")
+			return
+		}
+		status := handleStreamFrame(clientConf, frame, srcIP, srcport, isTCP)
+		_, err = conn.Write([]byte{status})
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error": err,
+				}).Error("Error writing stream frame status")
+			return
+		}
+	}
+}
+
+// handleStreamFrame sends the packet in a frame and returns its delivery status
+func handleStreamFrame(clientConf *tls.Config, frame []byte, srcIP net.IP, srcport int, checkIngress bool) byte {
+	header, err := parseHeader(&frame)
+	if err != nil {
+		incCounter("ingress_malformed")
+		return streamStatusRejected
+	}
+	if len(frame) > MaxDatagramSize {
+		incCounter("ingress_oversized")
+		return streamStatusRejected
+	}
+	if checkIngress && !ingressAllowed(srcIP, srcport, header) {
+		return streamStatusRejected
+	}
+	if header.Extensions.SourcePort != 0 {
+		srcport = header.Extensions.SourcePort
+	}
+	if header.PortNumber == 0 || header.PortNumber == 1023 {
+		return streamStatusRejected
+	}
+	if header.Extensions.isFanOut() {
+		dests, err := fanOutDestinations(header)
+		if err != nil {
+			return streamStatusRejected
+		}
+		status := byte(streamStatusQueued)
+		for _, dest := range dests {
+			done := fanOutDone(dest)
+			err := queueStreamPacket(clientConf, fanOutHeader(header, dest), frame, srcIP, srcport, done)
+			if err != nil {
+				done(err)
+				status = streamStatusUnreachable
+			}
+		}
+		return status
+	}
+	// multicast goes to every peer of the group, so there's no single result to report
+	if header.DestIPAddr.IsMulticast() {
+		if findMulticastGroup(header.DestIPAddr, header.PortNumber) == nil {
+			incCounter("multicast_no_group")
+			return streamStatusRejected
+		}
+		dispatchPacket(clientConf, header, frame, srcIP, srcport)
+		return streamStatusQueued
+	}
+	// the reply doesn't wait for the packet to be forwarded, the queue counts the result
+	err = queueStreamPacket(clientConf, header, frame, srcIP, srcport, nil)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error":    err,
+				"dest":     header.DestIPAddr.String(),
+				"desthost": header.DestHostname,
+			}).Error("Error sending stream frame")
+		return streamStatusUnreachable
+	}
+	return streamStatusQueued
+}
+
+// queueStreamPacket queues the packet in a stream frame for one destination, like
+// queueToDestination. A peer that's backing off is refused straight away instead of
+// holding the packet, so the application hears about it
+func queueStreamPacket(clientConf *tls.Config, header UDPRxHeader, data []byte, srcIP net.IP, srcport int, done func(error)) error {
+	if header.DestHostname != "" {
+		err := resolveHeader(&header)
+		if err != nil {
+			return err
+		}
+	}
+	status := GetPeerState(header.DestIPAddr.String())
+	if status.State == PeerBackingOff && time.Now().Before(status.NextRetry) {
+		return errPeerBackingOff
+	}
+	return queueToDestination(clientConf, header, data, srcIP, srcport, done)
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamFrame prefixes a packet with its length
+func streamFrame(packet []byte) []byte {
+	return append([]byte{byte(len(packet) >> 8), byte(len(packet))}, packet...)
+}
+
+func TestHandleStreamConn(t *testing.T) {
+	release := make(chan bool)
+	var sends sync.WaitGroup
+	sends.Add(2)
+	forwardPacketFunc = func(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
+		defer sends.Done()
+		if srcprt != UDPListenPort {
+			t.Errorf("wrong source port. Got %d", srcprt)
+		}
+		// the status is sent before a slow send finishes
+		if header.DestIPAddr.String() == "192.168.1.202" {
+			<-release
+			return errors.New("connection failed")
+		}
+		return nil
+	}
+	// the queued packets are sent in the background, so let them finish first
+	defer func() {
+		close(release)
+		sends.Wait()
+		forwardPacketFunc = forwardPacket
+	}()
+	// a peer that's backing off is refused straight away
+	peerStateFor("192.168.1.201").failed()
+	defer peerStates.Delete("192.168.1.201")
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleStreamConn(server, &tls.Config{})
+	frames := []struct {
+		packet []byte
+		status byte
+	}{
+		{[]byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 200, 0x80, 1, 2, 3}, streamStatusQueued},
+		{[]byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 201, 0x80, 1, 2, 3}, streamStatusUnreachable},
+		{[]byte{0x75, 0x02, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 202, 0x80, 1, 2, 3}, streamStatusQueued},
+		{[]byte{0x75, 0x09, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 200, 0x80, 1, 2, 3}, streamStatusRejected},
+		// reserved port
+		{[]byte{0x75, 0x02, 0x00, 0x00, 0x03, 0xFF, 0x04, 192, 168, 1, 200, 0x80, 1, 2, 3}, streamStatusRejected},
+	}
+	status := make([]byte, 1)
+	for i, frame := range frames {
+		_, err := client.Write(streamFrame(frame.packet))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = client.Read(status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status[0] != frame.status {
+			t.Errorf("frame %d: wrong status. Got %d, expected %d", i, status[0], frame.status)
+		}
+	}
+}
+
+func TestStreamListenerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "udprx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "udp_rx.sock")
+	done := make(chan error, 1)
+	go StreamListener("unix", path, &tls.Config{}, done)
+	var fi os.FileInfo
+	for i := 0; i < 100; i++ {
+		if _, ok := streamListeners.Load(path); ok {
+			fi, err = os.Stat(path)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fi == nil || err != nil {
+		t.Fatal("stream socket wasn't created", err)
+	}
+	if fi.Mode().Perm() != StreamSocketMode {
+		t.Errorf("wrong socket permissions. Got %v", fi.Mode().Perm())
+	}
+	ln, _ := streamListeners.Load(path)
+	ln.(net.Listener).Close()
+	streamListeners.Delete(path)
+	<-done
+}
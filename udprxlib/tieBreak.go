@@ -0,0 +1,74 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dialedLinks is a map of the Links we dialed to the fingerprint of the certificate
+// we dialed them with. Links that aren't in it were accepted from peers
+var dialedLinks sync.Map
+
+// certFingerprint returns the hex SHA-256 fingerprint of a DER certificate
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// localFingerprint returns the fingerprint of the certificate a config presents to
+// peers, or an empty string if it doesn't have one
+func localFingerprint(conf *tls.Config) string {
+	if conf == nil || len(conf.Certificates) == 0 || len(conf.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	return certFingerprint(conf.Certificates[0].Certificate[0])
+}
+
+// simultaneousWinner decides between a link we dialed and a link the same peer
+// dialed to us at the same time, with the peer's certificate fingerprint. Both peers
+// keep the link dialed by the one with the lower fingerprint, so they end up sending
+// on the same connection. It returns nil if existing isn't ours or either
+// fingerprint is unknown
+func simultaneousWinner(existing Link, incoming Link, peer string) Link {
+	value, ok := dialedLinks.Load(existing)
+	if !ok {
+		return nil
+	}
+	local := value.(string)
+	if local == "" || peer == "" || local == peer {
+		return nil
+	}
+	incCounter("simultaneous_links")
+	fields := log.Fields{
+		"remote": addrIP(incoming.RemoteAddr()),
+	}
+	if peer < local {
+		log.WithFields(fields).Info("Peer dialed us at the same time, switching to its link")
+		return incoming
+	}
+	log.WithFields(fields).Info("Peer dialed us at the same time, keeping our link")
+	return existing
+}
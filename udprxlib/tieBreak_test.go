@@ -0,0 +1,95 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalFingerprint(t *testing.T) {
+	if fp := localFingerprint(&tls.Config{}); fp != "" {
+		t.Errorf("config without a certificate shouldn't have a fingerprint. Got %s", fp)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{{1, 2, 3}}}}}
+	fp := localFingerprint(conf)
+	if len(fp) != 64 || fp != certFingerprint([]byte{1, 2, 3}) {
+		t.Errorf("wrong fingerprint. Got %s", fp)
+	}
+}
+
+func TestSimultaneousLinks(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.7.9"), Port: 55554}
+	header := UDPRxHeader{DestIPAddr: remote.IP}
+	before := GetCounters()["simultaneous_links"]
+	tests := []struct {
+		local        string
+		peer         string
+		keepIncoming bool
+		decided      bool
+	}{
+		{"ffff", "0000", true, true},
+		{"0000", "ffff", false, true},
+		{"0000", "", false, false},
+	}
+	for _, test := range tests {
+		dc, dp := net.Pipe()
+		dialed := &memLink{Conn: dc, remote: remote, protocol: linkProtocolV2, reader: bufio.NewReader(dc)}
+		connMap.Store("192.168.7.9|", dialed)
+		dialedLinks.Store(dialed, test.local)
+		ic, ip := net.Pipe()
+		incoming := &memLink{Conn: ic, remote: remote, protocol: linkProtocolV2, reader: bufio.NewReader(ic), peer: test.peer}
+		addConn("192.168.7.9", "127.0.0.1", incoming)
+		noSrc, _ := connMap.Load("192.168.7.9|")
+		complete, _ := connMap.Load("192.168.7.9|127.0.0.1")
+		switch {
+		case test.keepIncoming:
+			if noSrc != incoming || complete != incoming {
+				t.Errorf("%s should have switched to the peer's link from %s", test.local, test.peer)
+			}
+			// the losing link we dialed is closed gracefully
+			dp.SetReadDeadline(time.Now().Add(5 * time.Second))
+			frame, err := readFrame(bufio.NewReader(dp))
+			if err != nil || frame.Type != frameTypeClose {
+				t.Errorf("our link should have been closed with a close frame. Got %v", err)
+			}
+		case test.decided:
+			if noSrc != dialed || complete != nil {
+				t.Errorf("%s should have kept its link over the one from %s", test.local, test.peer)
+			}
+		default:
+			if noSrc != dialed || complete != incoming {
+				t.Error("without a fingerprint the existing link should be kept")
+			}
+		}
+		removeConn(header)
+		dialedLinks.Delete(dialed)
+		dc.Close()
+		dp.Close()
+		ic.Close()
+		ip.Close()
+	}
+	if GetCounters()["simultaneous_links"] != before+2 {
+		t.Errorf("wrong simultaneous link count. Got %d", GetCounters()["simultaneous_links"]-before)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// transport names used in the config file
+const (
+	TransportTLS  = "tls"
+	TransportDTLS = "dtls"
+)
+
+// DialTimeout is how long dialing a peer over TLS can take, including the handshake,
+// so a peer that doesn't answer fails its dial instead of holding it up for minutes
+var DialTimeout = 10 * time.Second
+
+// Transport dials and accepts links between udp_rx peers
+type Transport interface {
+	// Dial opens a link to the peer at address, from localIP if it isn't nil
+	Dial(address string, localIP net.IP, conf *tls.Config) (Link, error)
+	// Listen accepts links from peers on address. Accept returns Links
+	Listen(address string, conf *tls.Config) (net.Listener, error)
+}
+
+// Link is a connection to a peer that frames are sent and received on
+type Link interface {
+	net.Conn
+	// Protocol returns the link protocol negotiated with the peer, completing the
+	// handshake if needed. It's empty for peers that use the legacy framing
+	Protocol() string
+	// Reader returns the reader frames from the peer are read from
+	Reader() io.Reader
+	// MaxWrite is the most bytes that can be written in one Write, with every Write
+	// holding whole frames. 0 means the link is a stream with no limit
+	MaxWrite() int
+	// PeerFingerprint returns the fingerprint of the peer's certificate, completing
+	// the handshake if needed. It's empty if the peer didn't send one
+	PeerFingerprint() string
+}
+
+// transports are the available transports by config name
+var transports = map[string]Transport{
+	TransportTLS:  tlsTransport{},
+	TransportDTLS: dtlsTransport{},
+}
+
+// transportFor returns the transport for the peer a header is addressed to
+func transportFor(header UDPRxHeader) Transport {
+	if peer := peerConfFor(header); peer != nil && peer.Transport != "" {
+		return transports[peer.Transport]
+	}
+	return transports[TransportTLS]
+}
+
+// validTransport returns an error if name isn't a known transport
+func validTransport(name string) error {
+	if _, ok := transports[name]; !ok {
+		return fmt.Errorf("unknown transport %q", name)
+	}
+	return nil
+}
+
+// asLink returns conn as a Link. Connections that aren't Links are treated as TLS
+// streams if they're TLS, and legacy streams otherwise
+func asLink(conn net.Conn) Link {
+	if link, ok := conn.(Link); ok {
+		return link
+	}
+	return newTLSLink(conn)
+}
+
+// tlsTransport carries links over TLS on TCP
+type tlsTransport struct{}
+
+// tlsLink is a TLS or plain stream connection
+type tlsLink struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newTLSLink(conn net.Conn) *tlsLink {
+	return &tlsLink{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (l *tlsLink) Protocol() string {
+	tlsconn, ok := l.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	// a failed handshake shows up again on the first read
+	if tlsconn.Handshake() != nil {
+		return ""
+	}
+	return tlsconn.ConnectionState().NegotiatedProtocol
+}
+
+func (l *tlsLink) Reader() io.Reader {
+	return l.reader
+}
+
+func (l *tlsLink) MaxWrite() int {
+	return 0
+}
+
+func (l *tlsLink) PeerFingerprint() string {
+	tlsconn, ok := l.Conn.(*tls.Conn)
+	if !ok || tlsconn.Handshake() != nil {
+		return ""
+	}
+	certs := tlsconn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certFingerprint(certs[0].Raw)
+}
+
+func (tlsTransport) Dial(address string, localIP net.IP, conf *tls.Config) (Link, error) {
+	// the timeout covers the TLS handshake as well as the TCP connect
+	dialer := net.Dialer{Timeout: DialTimeout}
+	if len(localIP) > 0 {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	conn, err := tls.DialWithDialer(&dialer, "tcp", address, conf)
+	if err != nil {
+		return nil, err
+	}
+	return newTLSLink(conn), nil
+}
+
+func (tlsTransport) Listen(address string, conf *tls.Config) (net.Listener, error) {
+	ln, err := tls.Listen("tcp", address, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsListener{ln}, nil
+}
+
+// tlsListener accepts TLS links
+type tlsListener struct {
+	net.Listener
+}
+
+func (ln *tlsListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newTLSLink(conn), nil
+}
@@ -0,0 +1,367 @@
+// Copyright 2018 Otis Elevator Company. All rights reserved.
+// Use of this source code is govered by the MIT license which
+// can be found in the LICENSE file.
+
+// Author: Jeremy Mill: jeremy.mill@otis.com
+
+// Otis udp_rx software has been designed to utilize information
+// security technology described in the Category 5 – Part 2 of the
+// Commerce Control List, within Part 774 of the Export Administration
+// Regulations (“EAR”)(15 CFR 774).  However, the Otis udp_rx software
+// has been made publicly available in accordance with Part 742.15(b)
+// of the EAR and is therefore not subject to U.S. export regulations.
+// Before downloading this software, be aware that the country in which
+// you are located may have restrictions related to the import, download,
+// possession, use and/or reexport of encryption items.  It is your
+// responsibility to comply with any applicable laws and regulations
+// pertaining the import, download, possession, use and/or reexport of
+// encryption items.
+
+package udprxlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memTransport is an in-memory Transport for tests. Dialing an address connects a
+// net.Pipe to the listener at that address
+type memTransport struct {
+	mutex     sync.Mutex
+	listeners map[string]*memListener
+}
+
+// memLink is one end of an in-memory link
+type memLink struct {
+	net.Conn
+	local    net.Addr
+	remote   net.Addr
+	protocol string
+	reader   *bufio.Reader
+	peer     string
+	maxWrite int
+}
+
+func (l *memLink) LocalAddr() net.Addr     { return l.local }
+func (l *memLink) RemoteAddr() net.Addr    { return l.remote }
+func (l *memLink) Protocol() string        { return l.protocol }
+func (l *memLink) Reader() io.Reader       { return l.reader }
+func (l *memLink) MaxWrite() int           { return l.maxWrite }
+func (l *memLink) PeerFingerprint() string { return l.peer }
+
+// memListener accepts in-memory links
+type memListener struct {
+	transport *memTransport
+	addr      *net.TCPAddr
+	conf      *tls.Config
+	links     chan net.Conn
+	done      chan bool
+}
+
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case link := <-ln.links:
+		return link, nil
+	case <-ln.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (ln *memListener) Close() error {
+	ln.transport.mutex.Lock()
+	defer ln.transport.mutex.Unlock()
+	delete(ln.transport.listeners, ln.addr.String())
+	close(ln.done)
+	return nil
+}
+
+func (ln *memListener) Addr() net.Addr { return ln.addr }
+
+// memAddr parses an "ip:port" address
+func memAddr(address string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: portnum}, nil
+}
+
+func (t *memTransport) Listen(address string, conf *tls.Config) (net.Listener, error) {
+	addr, err := memAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.listeners == nil {
+		t.listeners = make(map[string]*memListener)
+	}
+	ln := &memListener{transport: t, addr: addr, conf: conf, links: make(chan net.Conn), done: make(chan bool)}
+	t.listeners[addr.String()] = ln
+	return ln, nil
+}
+
+func (t *memTransport) Dial(address string, localIP net.IP, conf *tls.Config) (Link, error) {
+	addr, err := memAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	ln, ok := t.listeners[addr.String()]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	if len(localIP) == 0 {
+		localIP = net.ParseIP("127.0.0.1")
+	}
+	local := &net.TCPAddr{IP: localIP, Port: 40000}
+	// negotiate the first protocol the client offers that the listener accepts
+	protocol := ""
+	for _, offered := range conf.NextProtos {
+		for _, accepted := range ln.conf.NextProtos {
+			if protocol == "" && offered == accepted {
+				protocol = offered
+			}
+		}
+	}
+	c, s := net.Pipe()
+	// each end sees the certificate of the config on the other end
+	server := &memLink{Conn: s, local: addr, remote: local, protocol: protocol, reader: bufio.NewReader(s), peer: localFingerprint(conf)}
+	select {
+	case ln.links <- server:
+	case <-ln.done:
+		return nil, errors.New("connection refused")
+	}
+	return &memLink{Conn: c, local: local, remote: addr, protocol: protocol, reader: bufio.NewReader(c), peer: localFingerprint(ln.conf)}, nil
+}
+
+// useMemTransport dials peers over an in-memory transport for the rest of a test, and
+// returns it with the connection handler the test's listeners should use. When the
+// test ends the links it handled are closed, and the transports and peerConfs are
+// only restored once the goroutines reading the links have exited
+func useMemTransport(t *testing.T, peers []PeerConf) (*memTransport, func(net.Conn, sendUDPFn)) {
+	mem := &memTransport{}
+	transports["mem"] = mem
+	oldPeers := peerConfs
+	peerConfs = peers
+	t.Cleanup(func() {
+		delete(transports, "mem")
+		peerConfs = oldPeers
+	})
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var links []net.Conn
+	closed := false
+	handle := func(conn net.Conn, sender sendUDPFn) {
+		mutex.Lock()
+		// a link that's only handled after the test has ended is closed straight away
+		if closed {
+			mutex.Unlock()
+			conn.Close()
+			return
+		}
+		links = append(links, conn)
+		wg.Add(1)
+		mutex.Unlock()
+		defer wg.Done()
+		handleConnection(conn, sender)
+	}
+	handleConnectionFunc = handle
+	t.Cleanup(func() {
+		handleConnectionFunc = handleConnection
+		mutex.Lock()
+		closed = true
+		for _, link := range links {
+			link.Close()
+		}
+		mutex.Unlock()
+		wg.Wait()
+	})
+	return mem, handle
+}
+
+func TestMemTransport(t *testing.T) {
+	mem, handle := useMemTransport(t, []PeerConf{{Address: "192.168.7.2", Transport: "mem"}})
+	ln, err := mem.Listen("192.168.7.2:55554", &tls.Config{NextProtos: linkProtocols})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type delivery struct {
+		srcip   string
+		srcport uint
+		destprt uint
+		data    []byte
+	}
+	delivered := make(chan delivery, 1)
+	sender := func(srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte, counter int) error {
+		delivered <- delivery{srcipstr, srcprt, destprt, append([]byte{}, data...)}
+		return nil
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			handle(conn, sender)
+		}
+	}()
+	header := UDPRxHeader{MajorVersion: 1, PortNumber: 50300, DestIPAddr: net.ParseIP("192.168.7.2")}
+	defer removeConn(header)
+	err = forwardPacket(&tls.Config{}, header, []byte{1, 2, 3}, 4000, ":55554")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-delivered:
+		if d.srcip != "127.0.0.1" || d.srcport != 4000 || d.destprt != 50300 || !bytes.Equal(d.data, []byte{1, 2, 3}) {
+			t.Errorf("wrong delivery. Got %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet wasn't delivered")
+	}
+	conn, err := getConn(header, &tls.Config{}, ":55554")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Protocol() != linkProtocolV2 {
+		t.Errorf("wrong negotiated protocol. Got %q", conn.Protocol())
+	}
+}
+
+func TestTransportFor(t *testing.T) {
+	defer func(peers []PeerConf) { peerConfs = peers }(peerConfs)
+	peerConfs = []PeerConf{{Address: "192.168.7.3", Transport: TransportDTLS}}
+	header := UDPRxHeader{DestIPAddr: net.ParseIP("192.168.7.3")}
+	if _, ok := transportFor(header).(dtlsTransport); !ok {
+		t.Error("configured peer should use dtls")
+	}
+	header.DestIPAddr = net.ParseIP("192.168.7.4")
+	if _, ok := transportFor(header).(tlsTransport); !ok {
+		t.Error("other peers should use tls")
+	}
+	if validTransport("carrier pigeon") == nil {
+		t.Error("unknown transport should be invalid")
+	}
+}
+
+func TestDTLSTransport(t *testing.T) {
+	// a refused handshake takes this long to fail
+	defer func(timeout time.Duration) { dtlsHandshakeTimeout = timeout }(dtlsHandshakeTimeout)
+	dtlsHandshakeTimeout = 2 * time.Second
+	modifyKeyPathsWindows()
+	rootCAs := ConfigureRootCAs(&cacertpath)
+	cer, err := tls.LoadX509KeyPair(certpath, keypath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := dtlsTransport{}.Listen("127.0.0.1:0", GetServerConfig(rootCAs, &cer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan Link, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn.(Link)
+		}
+	}()
+	clientConf := &tls.Config{
+		RootCAs:      rootCAs,
+		Certificates: []tls.Certificate{cer},
+		NextProtos:   linkProtocols,
+	}
+	client, err := dtlsTransport{}.Dial(ln.Addr().String(), nil, clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.Protocol() != linkProtocolV2 || client.MaxWrite() != dtlsMaxWrite {
+		t.Errorf("wrong link settings. Got protocol %q and max write %d", client.Protocol(), client.MaxWrite())
+	}
+	var server Link
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dtls link wasn't accepted")
+	}
+	defer server.Close()
+	// two frames in one datagram both come out
+	client.Write(append(encodeDataFrame(4000, 50300, 1, []byte{1, 2, 3}), encodeDataFrame(4000, 50300, 2, []byte{4})...))
+	for _, payload := range [][]byte{{1, 2, 3}, {4}} {
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		frame, err := readFrame(server.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame.Body[8:], payload) {
+			t.Errorf("wrong frame body. Got %v", frame.Body)
+		}
+	}
+	// a client without a certificate is refused
+	_, err = dtlsTransport{}.Dial(ln.Addr().String(), nil, &tls.Config{RootCAs: rootCAs})
+	if err == nil {
+		t.Error("client without a certificate should have been refused")
+	}
+}
+
+func TestDTLSDatagramLimit(t *testing.T) {
+	oldMax := MaxDatagramSize
+	defer func() { MaxDatagramSize = oldMax; peerConfs = nil }()
+	MaxDatagramSize = 65507
+	err := ApplyConfig(ConfFile{Peers: []PeerConf{{Address: "192.168.2.250", Transport: TransportDTLS}}})
+	if err == nil {
+		t.Error("datagrams too large for DTLS should be rejected")
+	}
+	err = ApplyConfig(ConfFile{DTLS: true, MaxDatagramSize: dtlsMaxDatagram + 1})
+	if err == nil {
+		t.Error("datagrams too large for DTLS should be rejected when accepting DTLS links")
+	}
+	err = ApplyConfig(ConfFile{DTLS: true, MaxDatagramSize: dtlsMaxDatagram})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the largest datagram still fits in one write once it's framed
+	frame := encodePayloadFrame(frameFlagSequenced, 4000, 5000, 1, net.ParseIP("ff02::1"), net.ParseIP("fd00::1"), make([]byte, dtlsMaxDatagram))
+	if len(frame) > dtlsMaxWrite {
+		t.Errorf("largest frame is %d bytes, more than a DTLS write", len(frame))
+	}
+}
+
+func TestTLSDialTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { DialTimeout = timeout }(DialTimeout)
+	DialTimeout = 100 * time.Millisecond
+	// a server that accepts the connection but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	start := time.Now()
+	_, err = tlsTransport{}.Dial(ln.Addr().String(), nil, &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		t.Fatal("dial to a peer that never answers should fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("dial took %v, it should have timed out", time.Since(start))
+	}
+}
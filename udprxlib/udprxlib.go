@@ -21,7 +21,6 @@
 package udprxlib
 
 import (
-	"bufio"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -52,17 +51,25 @@ var ForwardMap map[string]int
 var mutexMap = make(map[string]*sync.Mutex)
 var mutexWriterMutex = &sync.Mutex{}
 
-// connMap is a hashmap of strings (ip addresses in string form) to tls connection pointers
+// connMap is a hashmap of strings (ip addresses in string form) to Links
 // NOTE: the key here is a string in the form of "dest|src"
 var connMap = sync.Map{}
-var lastConnFail = sync.Map{}
 
-// RemoteTLSPort is the port of the remote TLS server (also the port of the local TLS server)
+// RemoteTLSPort is the default ":port" of the remote TLS server. Peers can override it
 var RemoteTLSPort = ":55554"
 
-// ConnTimeoutVal is a variable controlling how long to wait (in seconds)
-// before a connection is considered by us to be 'timed out'
-var ConnTimeoutVal float64 = 10
+// TLSListenPort is the port of the local TLS server
+var TLSListenPort = 55554
+
+// UDPListenPort is the local UDP ingress port
+var UDPListenPort = 55555
+
+// MaxDatagramSize is the largest payload, in bytes, that will be tunneled. Larger
+// datagrams and frames are dropped and counted
+var MaxDatagramSize = 65507
+
+// maxUDPReadSize is big enough to hold any UDP payload, so reads are never truncated
+const maxUDPReadSize = 65535
 
 // TCPSocketListener is the tls socket listener
 var TCPSocketListener net.Listener
@@ -70,8 +77,8 @@ var handleConnectionFunc = handleConnection
 
 // TCPListener is the tcp socket loop for udprx inbound connections
 func TCPListener(listenAddrFlag *string, serverConf *tls.Config, done chan error) {
-	listenAddr := fmt.Sprintf("%s:55554", *listenAddrFlag)
-	ln, err := tls.Listen("tcp", listenAddr, serverConf)
+	listenAddr := fmt.Sprintf("%s:%d", *listenAddrFlag, TLSListenPort)
+	ln, err := transports[TransportTLS].Listen(listenAddr, serverConf)
 	if err != nil {
 		log.WithFields(
 			log.Fields{
@@ -94,25 +101,50 @@ func TCPListener(listenAddrFlag *string, serverConf *tls.Config, done chan error
 	log.Debug("Created UDP socket")
 	defer ln.Close()
 	log.Info("Ready to accept TLS connections...")
+	acceptLinks(ln, done)
+}
+
+// DTLSSocketListener is the dtls socket listener
+var DTLSSocketListener net.Listener
+
+// DTLSListener accepts DTLS links from peers on UDP port TLSListenPort
+func DTLSListener(listenAddrFlag *string, serverConf *tls.Config, done chan error) {
+	listenAddr := fmt.Sprintf("%s:%d", *listenAddrFlag, TLSListenPort)
+	ln, err := transports[TransportDTLS].Listen(listenAddr, serverConf)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error": err,
+			}).Error("Error setting up dtls listener")
+		done <- err
+		return
+	}
+	DTLSSocketListener = ln
+	defer ln.Close()
+	log.Info("Ready to accept DTLS connections...")
+	acceptLinks(ln, done)
+}
+
+// acceptLinks caches and handles links from a transport's listener until it's closed
+func acceptLinks(ln net.Listener, done chan error) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.WithFields(
 				log.Fields{
 					"error": err,
-				}).Error("Error listening for TLS connections. Terminating TCPListener thread")
+				}).Error("Error listening for connections. Terminating listener thread")
 			done <- err
 			return
 		}
-		// put the connection into the mapping
-		remoteAddr := strings.Split(conn.RemoteAddr().String(), ":")[0]
-		localAddr := strings.Split(conn.LocalAddr().String(), ":")[0]
-		if tlsconn, ok := conn.(*tls.Conn); ok {
-			addConn(remoteAddr, localAddr, tlsconn)
-		}
-
-		// go handle a connection in a gothread
-		go handleConnectionFunc(conn, SendUDP)
+		// put the connection into the mapping and go handle it in a gothread. The
+		// mapping can need the handshake, which shouldn't hold up accepting others
+		go func(conn net.Conn) {
+			remoteAddr := strings.Split(conn.RemoteAddr().String(), ":")[0]
+			localAddr := strings.Split(conn.LocalAddr().String(), ":")[0]
+			addConn(remoteAddr, localAddr, asLink(conn))
+			handleConnectionFunc(conn, SendUDP)
+		}(conn)
 	}
 }
 
@@ -122,7 +154,7 @@ var forwardPacketFunc = forwardPacket
 
 // UDPListener is the udp local listener for outbound connections
 func UDPListener(listenAddrFlag *string, clientConf *tls.Config, done chan error) {
-	listenAddr := fmt.Sprintf("%s:55555", *listenAddrFlag)
+	listenAddr := fmt.Sprintf("%s:%d", *listenAddrFlag, UDPListenPort)
 	ServerAddr, err := net.ResolveUDPAddr("udp", listenAddr)
 	if err != nil {
 		log.WithFields(
@@ -147,9 +179,9 @@ func UDPListener(listenAddrFlag *string, clientConf *tls.Config, done chan error
 
 	// foreach udp packet
 	log.Info("Ready to accept connections...")
+	readbuf := make([]byte, maxUDPReadSize)
 	for {
-		buf := make([]byte, 1024)
-		n, src, err := ServerConn.ReadFromUDP(buf)
+		n, src, err := ServerConn.ReadFromUDP(readbuf)
 		if err != nil {
 			log.WithFields(
 				log.Fields{
@@ -158,95 +190,139 @@ func UDPListener(listenAddrFlag *string, clientConf *tls.Config, done chan error
 			done <- err
 			return
 		}
-		// parse and remove the header from the packet
-		header, err := parseHeader(&buf)
+		// copy the packet out of the read buffer, the header and data are used after
+		// the next read
+		data := make([]byte, n)
+		copy(data, readbuf[:n])
+		// parse and remove the header from the packet, leaving just the payload
+		header, err := parseHeader(&data)
 		if err != nil {
+			incCounter("ingress_malformed")
 			log.WithFields(
 				log.Fields{
 					"error": err,
 				}).Error("Error parsing header. continuing.")
 			continue
 		}
-		removedbytes := 7                      //starts at 7, which is the magic+version+destprt+ipversion
-		removedbytes += len(header.DestIPAddr) // add the length of the dest ip address
-		//if there was no src IP, just add 1 for the end of header magic number
-		if len(header.SourceIPAddr) == 0 {
-			removedbytes++
-		} else {
-			removedbytes++                           // add one for the src ip follows
-			removedbytes += len(header.SourceIPAddr) // add the length of the src ip address
-			removedbytes++                           // one more for the end of header number
-		}
-
-		// debug logging
-		if ForwardMap != nil {
-			fullAddr := fmt.Sprintf("%s:%d", header.DestIPAddr.String(), header.PortNumber)
-			// if nothing in forward map
-			if ForwardMap[fullAddr] == 0 {
-				ForwardMap[fullAddr] = 1
-				log.Debug("Forwarding first message to ", fullAddr)
-			} else {
-				ForwardMap[fullAddr] = ForwardMap[fullAddr] + 1
-				if ForwardMap[fullAddr]%100 == 0 {
-					log.Debug("Forwarded (another) 100 messages to ", fullAddr)
-				}
-			}
-		}
-		// end debug logging
-		// if farport is reserved, don't continue processing, get the next packet
-		if header.PortNumber == 0 || header.PortNumber == 1023 {
-			log.WithFields(
-				log.Fields{
-					"error":     err,
-					"dest port": header.PortNumber,
-				}).Error("Got a bad dest port")
-			continue
-		}
-		// if there was an error here, don't try and forward the packet
-		if err != nil {
+		if len(data) > MaxDatagramSize {
+			incCounter("ingress_oversized")
 			log.WithFields(
 				log.Fields{
-					"error": err,
-				}).Error("Error in packet, not forwarding")
+					"length": len(data),
+					"max":    MaxDatagramSize,
+				}).Error("Datagram larger than the max datagram size, dropping.")
 			continue
 		}
-		// catch if the dest is a local IP address
-		isLocalHost := false
-		ips, err := certcreator.GetIps()
-		if err != nil {
-			log.WithFields(
-				log.Fields{
-					"error": err,
-				}).Error("Error getting local ips for localhost checking")
+		// only accept datagrams from senders the ingress policy allows
+		if !ingressAllowed(src.IP, src.Port, header) {
 			continue
 		}
-		// build an ip string from the dest IP to check against localhost ips
-		for _, ip := range ips {
-			ipstring := ip.String()
-			_ = ipstring
-			if ip.String() == header.DestIPAddr.String() {
-				isLocalHost = true
-				break
-			}
+		// the header can override the port the local application sent from
+		srcport := src.Port
+		if header.Extensions.SourcePort != 0 {
+			srcport = header.Extensions.SourcePort
 		}
-		if isLocalHost {
-			// skip forward packet and go straight to sending a UDP packet to the local IP
-			err = SendUDP(src.IP.String(), header.DestIPAddr.String(), uint(src.Port), uint(header.PortNumber), buf[:n-removedbytes], 0)
+		dispatchPacket(clientConf, header, data, src.IP, srcport)
+	}
+}
+
+// dispatchPacket sends the payload of a packet received locally on to its destination.
+// Local destinations get the packet directly, anything else is forwarded over TLS
+func dispatchPacket(clientConf *tls.Config, header UDPRxHeader, data []byte, srcIP net.IP, srcport int) {
+	// packets for several destinations are sent to each of them separately
+	if header.Extensions.isFanOut() {
+		fanOutPacket(clientConf, header, data, srcIP, srcport)
+		return
+	}
+	// resolve a hostname destination so the connection is cached by address. A lookup
+	// that isn't cached runs in the background, so it doesn't hold up the caller
+	if header.DestHostname != "" {
+		whenResolved(header.DestHostname, func() {
+			err := resolveHeader(&header)
 			if err != nil {
 				log.WithFields(
 					log.Fields{
-						"error": err,
-					}).Error("Error sending to localhost")
+						"error":    err,
+						"desthost": header.DestHostname,
+					}).Error("Error resolving destination")
+				return
 			}
+			dispatchResolved(clientConf, header, data, srcIP, srcport)
+		})
+		return
+	}
+	dispatchResolved(clientConf, header, data, srcIP, srcport)
+}
+
+// dispatchResolved sends the payload of a packet whose destination has an address
+func dispatchResolved(clientConf *tls.Config, header UDPRxHeader, data []byte, srcIP net.IP, srcport int) {
+	// debug logging
+	if ForwardMap != nil {
+		fullAddr := fmt.Sprintf("%s:%d", header.DestIPAddr.String(), header.PortNumber)
+		// if nothing in forward map
+		if ForwardMap[fullAddr] == 0 {
+			ForwardMap[fullAddr] = 1
+			log.Debug("Forwarding first message to ", fullAddr)
 		} else {
-			// otherwise forward to dest
-			go forwardPacketFunc(clientConf, header, buf[:n-removedbytes], src.Port, RemoteTLSPort)
+			ForwardMap[fullAddr] = ForwardMap[fullAddr] + 1
+			if ForwardMap[fullAddr]%100 == 0 {
+				log.Debug("Forwarded (another) 100 messages to ", fullAddr)
+			}
+		}
+	}
+	// end debug logging
+	// if farport is reserved, don't continue processing
+	if header.PortNumber == 0 || header.PortNumber == 1023 {
+		log.WithFields(
+			log.Fields{
+				"dest port": header.PortNumber,
+			}).Error("Got a bad dest port")
+		return
+	}
+	// multicast destinations go to every peer subscribed to the group
+	if header.DestIPAddr.IsMulticast() {
+		forwardMulticast(clientConf, header, data, srcIP, srcport)
+		return
+	}
+	// catch if the dest is a local IP address
+	isLocalHost, err := isLocalIP(header.DestIPAddr)
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error": err,
+			}).Error("Error getting local ips for localhost checking")
+		return
+	}
+	if isLocalHost {
+		// skip forward packet and go straight to sending a UDP packet to the local IP
+		err = SendUDP(srcIP.String(), header.DestIPAddr.String(), uint(srcport), uint(header.PortNumber), data, 0)
+		if err != nil {
+			log.WithFields(
+				log.Fields{
+					"error": err,
+				}).Error("Error sending to localhost")
 		}
-		// clear the buffer for garbage collection by setting to nil explicitly
-		buf = nil
+	} else {
+		// otherwise queue it for the peer's writer, which keeps packets in order
+		enqueuePacket(clientConf, header, data, srcport, remotePortFor(header), nil)
 	}
 }
 
+// isLocalIP returns true if destip is one of the local IP addresses
+func isLocalIP(destip net.IP) (bool, error) {
+	ips, err := certcreator.GetIps()
+	if err != nil {
+		return false, err
+	}
+	// build an ip string from the dest IP to check against localhost ips
+	for _, ip := range ips {
+		if ip.String() == destip.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // ConfigureRootCAs creats a new systemcertpool and adds a cert
 // from a pem encoded cert file to it
 func ConfigureRootCAs(caCertPathFlag *string) *x509.CertPool {
@@ -300,30 +376,94 @@ func StopThreads() {
 	// close sockets
 	TCPSocketListener.Close()
 	UDPSocketListener.Close()
-	// close all open connections
+	if DTLSSocketListener != nil {
+		DTLSSocketListener.Close()
+	}
+	if TransparentSocketListener != nil {
+		TransparentSocketListener.Close()
+	}
+	staticTunnelListeners.Range(func(key, value interface{}) bool {
+		value.(*net.UDPConn).Close()
+		return true
+	})
+	multicastListeners.Range(func(key, value interface{}) bool {
+		value.(*net.UDPConn).Close()
+		return true
+	})
+	broadcastListeners.Range(func(key, value interface{}) bool {
+		value.(*net.UDPConn).Close()
+		return true
+	})
+	streamListeners.Range(func(key, value interface{}) bool {
+		value.(net.Listener).Close()
+		return true
+	})
+	// close all open connections, telling peers that understand it that we're going
 	connMap.Range(func(key, value interface{}) bool {
-		value.(*tls.Conn).Close()
+		if link, ok := value.(Link); ok {
+			closeLink(link)
+		}
 		return true
 	})
 	connMap = sync.Map{}
 }
 
-// addConn caches a connection for an incoming TLS connection
-func addConn(remoteAddr, localAddr string, conn *tls.Conn) {
+// addConn caches a connection for an incoming link
+func addConn(remoteAddr, localAddr string, conn Link) {
 	// create a new mutex for this address if one doesn't exist
 	mapKeyComplete := fmt.Sprintf("%s|%s", remoteAddr, localAddr)
 	mapKeyNoSrc := fmt.Sprintf("%s|", remoteAddr)
 	keys := [2]string{mapKeyComplete, mapKeyNoSrc}
+	// finish the handshake before locking, a peer dialing us at the same time holds
+	// its own lock until we do
+	peer := ""
+	if conn != nil {
+		peer = conn.PeerFingerprint()
+	}
+	// a peer that got a verified link to us is reachable, whatever our dials say
+	if peer != "" {
+		peerStateFor(remoteAddr).connected()
+		// packets sent while it was unreachable can go now
+		go flushPending(remoteAddr)
+	}
+	for _, key := range keys {
+		mu := connMutex(key)
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	// if we dialed the peer while it was dialing us, only one of the links is kept
+	var replaced []Link
+	for _, key := range keys {
+		existing, _ := connMap.Load(key)
+		link, ok := existing.(Link)
+		if !ok || conn == nil || link == conn {
+			continue
+		}
+		if len(replaced) > 0 && link == replaced[len(replaced)-1] {
+			connMap.Delete(key)
+			continue
+		}
+		switch simultaneousWinner(link, conn, peer) {
+		case link:
+			// the peer closes its link once it sees ours
+			return
+		case conn:
+			replaced = append(replaced, link)
+			connMap.Delete(key)
+		}
+	}
 	for _, key := range keys {
-		checkMutexMapMutex(key)
-		mutexMap[key].Lock()
-		defer mutexMap[key].Unlock()
 		existingConn, _ := connMap.Load(key)
 		// check if there's already a connection, if there is, do nothing, it should be OK
 		if existingConn == nil {
 			connMap.Store(key, conn)
 		}
 	}
+	// we dialed the losing link, so we close it once what's been sent on it is flushed
+	for _, link := range replaced {
+		dialedLinks.Delete(link)
+		go closeLink(link)
+	}
 }
 
 // ensure that there is a connection mutex for this address
@@ -338,16 +478,44 @@ func checkMutexMapMutex(addr string) bool {
 	return createdMutex
 }
 
-// this handles an incoming TLS connection, sending udp packets to a sendUDPFn
+// gets the connection mutex for this address, creating it if needed
+func connMutex(addr string) *sync.Mutex {
+	checkMutexMapMutex(addr)
+	mutexWriterMutex.Lock()
+	defer mutexWriterMutex.Unlock()
+	return mutexMap[addr]
+}
+
+// this handles an incoming link, sending udp packets to a sendUDPFn
 func handleConnection(conn net.Conn, sender sendUDPFn) {
 	defer conn.Close()
-	// create a a reader for the connection
-	r := bufio.NewReader(conn)
+	// a closed link is no use to anyone sending to the peer
+	defer forgetConn(conn)
+	// get the reader for the link
+	link := asLink(conn)
+	r := link.Reader()
+	// peers that negotiated typed frames get them, anything else uses the legacy framing
+	if link.Protocol() == linkProtocolV2 {
+		// tell the peer what we can decompress, without holding up reading its frames
+		go conn.Write(encodeSettingsFrame())
+		stopKeepalive := make(chan bool)
+		keepaliveDone := make(chan bool)
+		go func() {
+			keepalive(conn, stopKeepalive)
+			close(keepaliveDone)
+		}()
+		handleFrames(conn, r, sender)
+		close(stopKeepalive)
+		// closing the link frees a ping that's stuck writing to it, and the link isn't
+		// done with until its keepalive is
+		conn.Close()
+		<-keepaliveDone
+		return
+	}
 	counter := 0
 	lastLoopEOF := false
 	for {
 		// create buffers
-		buf := make([]byte, 1024)
 		lenbytes := make([]byte, 2)
 		srcprtbytes := make([]byte, 2)
 		destportbytes := make([]byte, 2)
@@ -409,106 +577,130 @@ func handleConnection(conn net.Conn, sender sendUDPFn) {
 				}).Error("invalid destination port number")
 			return
 		}
-		// get the rest of the data. It's mlength-2 because we already got destport
-		_, err2 := io.ReadAtLeast(r, buf, mlength-2)
-		if err2 != nil {
+		// skip over frames that are too big, the stream is still in sync after them
+		if mlength > MaxDatagramSize {
+			incCounter("frames_oversized")
 			log.WithFields(
 				log.Fields{
-					"error": err,
-				}).Error("Error getting data bytes from message")
-			return
-		}
-		// get the remote (sender) ip and port
-		rxipandport := conn.RemoteAddr().String()
-		// get the ip and port the sender connected to (might be multiple)
-		localipandport := conn.LocalAddr().String()
-		// split out just the IPs into a string
-		remoteIP := strings.Split(rxipandport, ":")[0]
-		localIP := strings.Split(localipandport, ":")[0]
-		// if netprofiling, add the time bytes
-		if netProfiling {
-			for index, element := range getTimeBytes() {
-				buf[mlength-2+index] = element
-				//fmt.Printf("udpx - %d\n", element)
+					"length": mlength,
+					"max":    MaxDatagramSize,
+				}).Error("Frame larger than the max datagram size, dropping")
+			_, err = io.CopyN(ioutil.Discard, r, int64(mlength))
+			if err != nil {
+				return
 			}
-			mlength = mlength + 8
+			continue
 		}
-		// craft and send a UDP packet
-		log.WithFields(log.Fields{
-			"remote_ip": remoteIP,
-			"local_ip":  localIP,
-			"srcport":   srcport,
-			"destport":  destport,
-		}).Debug("Sending UDP packet")
-		// sending to local IP:destport, from remoteIP:srcport
-		err = sender(remoteIP, localIP, srcport, destport, buf[:mlength], counter)
+		// get the rest of the data, with room for the profiling timestamp
+		buf := make([]byte, mlength+8)
+		_, err = io.ReadFull(r, buf[:mlength])
 		if err != nil {
+			incCounter("frames_malformed")
 			log.WithFields(
 				log.Fields{
-					"error":    err,
-					"remoteIP": remoteIP,
-					"localIP":  localIP,
-					"srcport":  srcport,
-					"destport": destport,
-				}).Error("Error sending to local IP:Port")
+					"error": err,
+				}).Error("Error getting data bytes from message")
 			return
 		}
-		// if we're cpu profiling, keep track of when to stop the profile
-		if cpuProfiling {
-			counter++
-			if counter > maxProfilingPackets {
-				log.Warning("Stopping CPU profiling")
-				pprof.StopCPUProfile()
-				cpuProfiling = false
-			}
+		err = receivedPacket(conn, srcport, destport, nil, nil, buf, mlength, &counter, sender)
+		if err != nil {
+			return
 		}
-		// debug logging code
-		if ForwardMap != nil {
-			// this string is in form [fromIpAddress]-[destination port]
-			debugmapstring := fmt.Sprintf("%s-%d", remoteIP, destport)
-			if ForwardMap[debugmapstring] == 0 {
-				ForwardMap[debugmapstring] = 1
-				log.Debug("Forwarding first message to ", debugmapstring)
-			} else {
-				ForwardMap[debugmapstring] = ForwardMap[debugmapstring] + 1
-				if ForwardMap[debugmapstring]%100 == 0 {
-					log.Debug("Forwarded (another) 100 messages to ", debugmapstring)
-				}
+	}
+}
+
+// receivedPacket sends a packet from a peer on to the local network. group is the
+// multicast group the peer sent it for, or nil, and source is the multicast packet's
+// original sender. buf has room after the first mlength bytes for the profiling
+// timestamp. Errors are logged here
+func receivedPacket(conn net.Conn, srcport uint, destport uint, group net.IP, source net.IP, buf []byte, mlength int, counter *int, sender sendUDPFn) error {
+	// get the remote (sender) ip and port
+	rxipandport := conn.RemoteAddr().String()
+	// get the ip and port the sender connected to (might be multiple)
+	localipandport := conn.LocalAddr().String()
+	// split out just the IPs into a string
+	remoteIP := strings.Split(rxipandport, ":")[0]
+	localIP := strings.Split(localipandport, ":")[0]
+	// if netprofiling, add the time bytes
+	if netProfiling {
+		for index, element := range getTimeBytes() {
+			buf[mlength-2+index] = element
+			//fmt.Printf("udpx - %d\n", element)
+		}
+		mlength = mlength + 8
+	}
+	// craft and send a UDP packet
+	log.WithFields(log.Fields{
+		"remote_ip": remoteIP,
+		"local_ip":  localIP,
+		"srcport":   srcport,
+		"destport":  destport,
+	}).Debug("Sending UDP packet")
+	// packets a peer sent for a multicast group are re-emitted to the group and
+	// packets for a broadcast relay's port are re-broadcast,
+	// everything else is sent to local IP:destport, from remoteIP:srcport
+	var err error
+	if group != nil {
+		err = deliverMulticast(group, source, remoteIP, srcport, destport, buf[:mlength])
+	} else if relay := broadcastRelayFor(remoteIP, destport); relay != nil {
+		err = deliverBroadcast(relay, remoteIP, srcport, destport, buf[:mlength])
+	} else {
+		err = sender(remoteIP, localIP, srcport, destport, buf[:mlength], *counter)
+		// remember the flow so the application's replies can be sent back
+		if err == nil && ReplySessions {
+			recordSession(conn, remoteIP, localIP, srcport, destport)
+		}
+	}
+	if err != nil {
+		log.WithFields(
+			log.Fields{
+				"error":    err,
+				"remoteIP": remoteIP,
+				"localIP":  localIP,
+				"srcport":  srcport,
+				"destport": destport,
+			}).Error("Error sending to local IP:Port")
+		return err
+	}
+	// if we're cpu profiling, keep track of when to stop the profile
+	if cpuProfiling {
+		*counter++
+		if *counter > maxProfilingPackets {
+			log.Warning("Stopping CPU profiling")
+			pprof.StopCPUProfile()
+			cpuProfiling = false
+		}
+	}
+	// debug logging code
+	if ForwardMap != nil {
+		// this string is in form [fromIpAddress]-[destination port]
+		debugmapstring := fmt.Sprintf("%s-%d", remoteIP, destport)
+		if ForwardMap[debugmapstring] == 0 {
+			ForwardMap[debugmapstring] = 1
+			log.Debug("Forwarding first message to ", debugmapstring)
+		} else {
+			ForwardMap[debugmapstring] = ForwardMap[debugmapstring] + 1
+			if ForwardMap[debugmapstring]%100 == 0 {
+				log.Debug("Forwarded (another) 100 messages to ", debugmapstring)
 			}
 		}
 	}
+	return nil
 }
 
 // forwardPacket sends the data from a udp packet received locally and
 // transmits it over TLS to another udprx instance
 func forwardPacket(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int, remoteTLSPort string) error {
-	// prepend the number of bytes into
-	lenbytes := intToBytes(len(data))
-	if netProfiling {
-		lenbytes = intToBytes(len(data) + 8)
-	}
-	srcbytes := intToBytes(srcprt)
-	newdata := make([]byte, len(data)+newdatalen)
-	// put the mlength
-	newdata[0] = lenbytes[0]
-	newdata[1] = lenbytes[1]
-	// put the srcport
-	newdata[2] = srcbytes[0]
-	newdata[3] = srcbytes[1]
-	// put the dest port
-	portbytes := intToBytes(header.PortNumber)
-	newdata[4] = portbytes[0]
-	newdata[5] = portbytes[1]
-	// copy the data over
-	copy(newdata[6:], data)
-	// if we're net profiling, add the timestamp
-	if netProfiling {
-		copy(newdata[4+len(data):], getTimeBytes())
+	if len(data) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is larger than the max of %d", len(data), MaxDatagramSize)
 	}
 	try := 0
+	// the sequence number is kept across retries so a retried packet isn't a gap
+	var seq uint32
+	sequenced := false
 	for {
 		// get a cached conn or create a new one
-		conn, err := getConn(header, conf, remoteTLSPort)
+		conn, err := getLaneConn(header, conf, remoteTLSPort, laneFor(header, srcprt))
 		if err != nil {
 			_, ok := err.(*connTimeoutError)
 			if !ok {
@@ -517,10 +709,26 @@ func forwardPacket(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int
 						"error": err,
 					}).Error("Non-timeout error in getConn")
 			}
-			return err
+			return &peerUnavailableError{err}
+		}
+		// frame the data for the protocol the peer speaks
+		var newdata []byte
+		if conn.Protocol() == linkProtocolV2 {
+			if !sequenced {
+				seq = nextSequence(conn, uint(srcprt), uint(header.PortNumber))
+				sequenced = true
+			}
+			newdata = encodeLinkDataFrame(conn, srcprt, header.PortNumber, seq, header.MulticastGroup, header.MulticastSource, data)
+		} else if header.MulticastGroup != nil {
+			return fmt.Errorf("the link to %s can't carry multicast", header.DestIPAddr.String())
+		} else {
+			newdata = encodeLegacyFrame(srcprt, header.PortNumber, data)
+		}
+		if max := conn.MaxWrite(); max > 0 && len(newdata) > max {
+			return fmt.Errorf("datagram of %d bytes is too large for the link to %s", len(data), header.DestIPAddr.String())
 		}
 		// write the data to a successful connection
-		n, err := conn.Write(newdata)
+		n, err := writeLink(conn, newdata)
 		if err != nil {
 			// if there was an error, try again 3 times, then remove the connection
 			log.WithFields(
@@ -551,99 +759,131 @@ func forwardPacket(conf *tls.Config, header UDPRxHeader, data []byte, srcprt int
 	}
 }
 
+// encodeLegacyFrame frames data for peers that don't speak typed frames:
+// length(2), srcport(2), destport(2), data
+func encodeLegacyFrame(srcprt int, destport int, data []byte) []byte {
+	// prepend the number of bytes into
+	lenbytes := intToBytes(len(data))
+	if netProfiling {
+		lenbytes = intToBytes(len(data) + 8)
+	}
+	srcbytes := intToBytes(srcprt)
+	newdata := make([]byte, len(data)+newdatalen)
+	// put the mlength
+	newdata[0] = lenbytes[0]
+	newdata[1] = lenbytes[1]
+	// put the srcport
+	newdata[2] = srcbytes[0]
+	newdata[3] = srcbytes[1]
+	// put the dest port
+	portbytes := intToBytes(destport)
+	newdata[4] = portbytes[0]
+	newdata[5] = portbytes[1]
+	// copy the data over
+	copy(newdata[6:], data)
+	// if we're net profiling, add the timestamp
+	if netProfiling {
+		copy(newdata[4+len(data):], getTimeBytes())
+	}
+	return newdata
+}
+
 // gets or creates a new TLS connection to a remote host
-func getConn(header UDPRxHeader, conf *tls.Config, remotePort string) (*tls.Conn, error) {
+func getConn(header UDPRxHeader, conf *tls.Config, remotePort string) (Link, error) {
+	return getLaneConn(header, conf, remotePort, 0)
+}
+
+// gets or creates one of the connections to a remote host that flows are spread over
+func getLaneConn(header UDPRxHeader, conf *tls.Config, remotePort string, lane int) (Link, error) {
 	// create a new mutex for this address if one doesn't exist
-	var mapKey string
-	if len(header.SourceIPAddr) > 0 {
-		mapKey = fmt.Sprintf("%s|%s", header.DestIPAddr.String(), header.SourceIPAddr.String())
-	} else {
-		mapKey = fmt.Sprintf("%s|", header.DestIPAddr.String())
-	}
-	checkMutexMapMutex(mapKey)
+	mapKey := connKey(header, lane)
+	mu := connMutex(mapKey)
 	// lock and defer closing
-	mutexMap[mapKey].Lock()
-	defer mutexMap[mapKey].Unlock()
+	mu.Lock()
+	defer mu.Unlock()
 	// also check
 	conn, _ := connMap.Load(mapKey)
 	// if there's no connection, try to create one
 	if conn == nil {
-		// if it's been less than ConnTimeoutVal seconds: don't try and create a new connection
-		// and return an error
-		lastFail, ok := lastConnFail.Load(mapKey)
-		if ok {
-			if time.Since(lastFail.(time.Time)).Seconds() < ConnTimeoutVal {
-				return nil, &connTimeoutError{"Connection hasn't timed out"}
-			}
+		// if the peer is backing off after failed dials: don't try and create a new
+		// connection and return an error
+		peer := peerStateFor(header.DestIPAddr.String())
+		if !peer.dialing() {
+			return nil, &connTimeoutError{"Connection hasn't timed out"}
 		}
 		log.Info("creating new cached connection for: ", mapKey)
-		// If there is no source IP, we can do the easy tls.Dial
-		var newconn *tls.Conn
-		var err error
-		// if there's no SourceIPAddr, do the standard tls dial
+		// offer the typed frame protocol. Old peers don't answer and get legacy frames
+		conf = conf.Clone()
+		conf.NextProtos = linkProtocols
+		// dial the peer over its transport, from the source IP if there is one,
 		// and cache the connection on success
-		if len(header.SourceIPAddr) == 0 {
-			newconn, err = tls.Dial("tcp", header.DestIPAddr.String()+remotePort, conf)
-			if err != nil {
-				log.WithFields(
-					log.Fields{
-						"error":      err,
-						"destip":     header.DestIPAddr.String(),
-						"remoteport": remotePort,
-					}).Error("Error dialing destination")
-				lastConnFail.Store(mapKey, time.Now())
-				return nil, err
-			}
-			connMap.Store(mapKey, newconn)
-		} else {
-			// if there is a sending IP, use a dialer to force a source IP
-			dialer := net.Dialer{
-				LocalAddr: &net.TCPAddr{IP: header.SourceIPAddr},
-			}
-			newconn, err = tls.DialWithDialer(&dialer, "tcp", header.DestIPAddr.String()+remotePort, conf)
-			if err != nil {
-				log.WithFields(
-					log.Fields{
-						"error":      err,
-						"destip":     header.DestIPAddr.String(),
-						"remoteport": remotePort,
-						"sourceip":   header.SourceIPAddr,
-					}).Error("Error dialing destination with source ip")
-				lastConnFail.Store(mapKey, time.Now())
-				return nil, err
-			}
-			connMap.Store(mapKey, newconn)
+		newconn, err := transportFor(header).Dial(header.DestIPAddr.String()+remotePort, header.SourceIPAddr, conf)
+		if isProtocolMismatch(err) {
+			log.WithFields(
+				log.Fields{
+					"error":     err,
+					"destip":    header.DestIPAddr.String(),
+					"protocols": linkProtocols,
+				}).Error("Peer doesn't support any of our link protocol versions")
 		}
+		if err != nil {
+			retry := peer.failed()
+			log.WithFields(
+				log.Fields{
+					"error":      err,
+					"destip":     header.DestIPAddr.String(),
+					"remoteport": remotePort,
+					"sourceip":   header.SourceIPAddr,
+					"retry":      retry.Format(time.RFC3339),
+				}).Error("Error dialing destination")
+			return nil, err
+		}
+		peer.connected()
+		connMap.Store(mapKey, newconn)
+		dialedLinks.Store(newconn, localFingerprint(conf))
 		// start listening for connections in on this connection
-		go handleConnection(newconn, SendUDP)
-		// debug logging
-		if ForwardMap != nil {
-			connstate := newconn.ConnectionState()
+		go handleConnectionFunc(newconn, SendUDP)
+		// count the handshake and do the debug logging
+		if link, ok := newconn.(*tlsLink); ok {
+			if tlsconn, ok := link.Conn.(*tls.Conn); ok {
+				connstate := tlsconn.ConnectionState()
+				countHandshake(connstate)
+				if ForwardMap != nil {
+					log.WithFields(log.Fields{
+						"Version":                 connstate.Version,
+						"Handshake complete":      connstate.HandshakeComplete,
+						"Resumed":                 connstate.DidResume,
+						"CipherSuite":             connstate.CipherSuite,
+						"NegotiatedProto":         connstate.NegotiatedProtocol,
+						"NegotiatedProtoIsMutual": connstate.NegotiatedProtocolIsMutual,
+						"LinkVersion":             linkVersion(connstate.NegotiatedProtocol),
+					}).Debug("Connection Information:")
+				}
+			}
+		} else if ForwardMap != nil {
 			log.WithFields(log.Fields{
-				"Version":                 connstate.Version,
-				"Handshake complete":      connstate.HandshakeComplete,
-				"CipherSuite":             connstate.CipherSuite,
-				"NegotiatedProto":         connstate.NegotiatedProtocol,
-				"NegotiatedProtoIsMutual": connstate.NegotiatedProtocolIsMutual,
+				"NegotiatedProto": newconn.Protocol(),
+				"LinkVersion":     linkVersion(newconn.Protocol()),
 			}).Debug("Connection Information:")
 		}
 		return newconn, nil
 	}
-	return conn.(*tls.Conn), nil
+	return conn.(Link), nil
 }
 
 // removeconn will remove all connections to the remote host, regardless of sending IP address
 func removeConn(header UDPRxHeader) {
 	mapKey := fmt.Sprintf("%s|%s", header.DestIPAddr.String(), header.SourceIPAddr.String())
-	checkMutexMapMutex(mapKey)
-	mutexMap[mapKey].Lock()
-	defer mutexMap[mapKey].Unlock()
+	mu := connMutex(mapKey)
+	mu.Lock()
+	defer mu.Unlock()
 	connMap.Range(func(key, value interface{}) bool {
 		if strings.HasPrefix(key.(string), header.DestIPAddr.String()) {
 			connMap.Delete(key)
 		}
 		return true
 	})
+	peerStateFor(header.DestIPAddr.String()).disconnected()
 }
 
 // UDPRxHeader represents the udp_rx header on incoming udp_packets
@@ -655,12 +895,37 @@ type UDPRxHeader struct {
 	// Port number and Dest IP address
 	PortNumber int
 	DestIPAddr net.IP
+	// Destination DNS name, only present in 2.x headers. Resolved into DestIPAddr
+	// by the listener before a connection is made
+	DestHostname string
 	// Optional source IP address
 	SourceIPAddr net.IP
+	// Extension fields, only present in 2.x headers
+	Extensions HeaderExtensions
+	// Multicast group a packet to a peer is for and the local sender it came from.
+	// They aren't part of the header, they're set when a group's packets are forwarded
+	// and sent to the peer in the data frame
+	MulticastGroup  net.IP
+	MulticastSource net.IP
 }
 
 // parseHeader returns a UDPRxHeader and removes it from the buffer
 func parseHeader(buf *[]byte) (UDPRxHeader, error) {
+	if len(*buf) < 7 {
+		return UDPRxHeader{}, errors.New("header too short")
+	}
+	// dispatch on the major version. 0.x and 1.x senders share the original layout
+	switch (*buf)[1] {
+	case 0, 1:
+		return parseHeaderV1(buf)
+	case 2:
+		return parseHeaderV2(buf)
+	}
+	return UDPRxHeader{}, fmt.Errorf("unsupported header version %d", (*buf)[1])
+}
+
+// parseHeaderV1 returns a 1.0.0 UDPRxHeader and removes it from the buffer
+func parseHeaderV1(buf *[]byte) (UDPRxHeader, error) {
 	header := UDPRxHeader{}
 	// version
 	header.MajorVersion = (*buf)[1]
@@ -672,14 +937,17 @@ func parseHeader(buf *[]byte) (UDPRxHeader, error) {
 	nextindex := -1
 	ipversion := int((*buf)[6])
 	if ipversion == 4 {
-		header.DestIPAddr = (*buf)[7:11]
 		nextindex = 11
 	} else if ipversion == 6 {
-		header.DestIPAddr = (*buf)[7:23]
 		nextindex = 23
 	} else {
 		return UDPRxHeader{}, errors.New("unsupported IP version")
 	}
+	// the address and the byte after it have to be there
+	if len(*buf) <= nextindex {
+		return UDPRxHeader{}, errors.New("header too short")
+	}
+	header.DestIPAddr = (*buf)[7:nextindex]
 	// if the next byte after the IP address is 0x80, we're done
 	if (*buf)[nextindex] == 0x80 {
 		*buf = (*buf)[nextindex+1:]
@@ -689,6 +957,9 @@ func parseHeader(buf *[]byte) (UDPRxHeader, error) {
 		return header, nil
 	} else if (*buf)[nextindex] == 0x76 {
 		// otherwise, if it's 0x76, set the src IP
+		if len(*buf) < nextindex+len(header.DestIPAddr)+2 {
+			return UDPRxHeader{}, errors.New("header too short")
+		}
 		if ipversion == 4 {
 			header.SourceIPAddr = (*buf)[12:16]
 			*buf = (*buf)[17:]
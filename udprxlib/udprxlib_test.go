@@ -468,3 +468,98 @@ func TestParseHeader6NoSrc(t *testing.T) {
 		t.Errorf("Wrong Dest IP. Got %s", header.DestIPAddr.String())
 	}
 }
+
+func TestParseHeaderV1Truncated(t *testing.T) {
+	headers := [][]byte{
+		{0x75, 0x01, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 100, 0x80},
+		{0x75, 0x01, 0x00, 0x00, 0xC4, 0x7C, 0x04, 192, 168, 1, 100, 0x76, 192, 168, 1, 102, 0x80},
+		{0x75, 0x01, 0x00, 0x00, 0xC4, 0x7C, 0x06, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x80},
+		{0x75, 0x01, 0x00, 0x00, 0xC4, 0x7C, 0x06, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x76, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0x80},
+	}
+	for _, full := range headers {
+		for i := 0; i < len(full); i++ {
+			// an exact length buffer, like the listener reads each datagram into
+			buf := make([]byte, i)
+			copy(buf, full)
+			_, err := parseHeader(&buf)
+			if err == nil {
+				t.Errorf("header %v truncated to %d bytes should not parse", full, i)
+			}
+		}
+		buf := make([]byte, len(full))
+		copy(buf, full)
+		if _, err := parseHeader(&buf); err != nil {
+			t.Errorf("header %v should parse. Got %v", full, err)
+		}
+	}
+}
+
+// TestHandleConnLargeFrame checks that a full size datagram makes it through intact
+// and that oversized frames are skipped without losing the stream
+func TestHandleConnLargeFrame(t *testing.T) {
+	client, server := net.Pipe()
+	large := make([]byte, 65507)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	go func() {
+		// a frame over the max, followed by a full size one
+		MaxDatagramSize = 60000
+		oversized := make([]byte, 6+60001)
+		copy(oversized, []byte{0xEA, 0x61, 0x11, 0x93, 0x11, 0x92})
+		client.Write(oversized)
+		frame := append([]byte{0x00, 0x64, 0x11, 0x93, 0x11, 0x92}, large[:100]...)
+		client.Write(frame)
+		client.Close()
+	}()
+	received := 0
+	handleConnection(server, func(srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte, counter int) error {
+		received++
+		if len(data) != 100 {
+			t.Errorf("wrong data length. Got %d", len(data))
+		}
+		return nil
+	})
+	MaxDatagramSize = 65507
+	if received != 1 {
+		t.Errorf("only the frame under the max should have been delivered. Got %d", received)
+	}
+	client, server = net.Pipe()
+	go func() {
+		frame := append([]byte{0xFF, 0xE3, 0x11, 0x93, 0x11, 0x92}, large...)
+		client.Write(frame)
+		client.Close()
+	}()
+	handleConnection(server, func(srcipstr string, destipstr string, srcprt uint, destprt uint, data []byte, counter int) error {
+		received++
+		if len(data) != 65507 {
+			t.Fatalf("wrong data length. Got %d", len(data))
+		}
+		for i := range data {
+			if data[i] != byte(i) {
+				t.Fatalf("data malformed at byte %d", i)
+			}
+		}
+		return nil
+	})
+	if received != 2 {
+		t.Errorf("full size frame was not delivered")
+	}
+}
+
+// TestMaxDatagramSizeConfig checks that a max datagram size a UDP payload can't have is rejected
+func TestMaxDatagramSizeConfig(t *testing.T) {
+	defer func() { MaxDatagramSize = 65507 }()
+	for _, size := range []int{-1, 65508} {
+		if err := ApplyConfig(ConfFile{MaxDatagramSize: size}); err == nil {
+			t.Errorf("max datagram size %d should have been rejected", size)
+		}
+	}
+	if err := ApplyConfig(ConfFile{MaxDatagramSize: 1400}); err != nil {
+		t.Errorf("valid max datagram size rejected: %v", err)
+	}
+	if MaxDatagramSize != 1400 {
+		t.Errorf("max datagram size not applied. Got %d", MaxDatagramSize)
+	}
+}
@@ -84,6 +84,12 @@ func SendUDP(srcipstr string, destipstr string, srcprt uint, destprt uint, data
 	return nil
 }
 
+// SendMulticastUDP sends a UDP packet to a multicast group the same way as SendUDP.
+// On windows the interface is picked by the routing table, so ifname is ignored
+func SendMulticastUDP(ifname string, srcipstr string, groupstr string, srcprt uint, destprt uint, data []byte) error {
+	return SendUDP(srcipstr, groupstr, srcprt, destprt, data, 0)
+}
+
 // helper to turn a uint into it's lower 2 bytes
 func uintToBytes(input uint) []byte {
 	// this must be less than 1024 so we only have a few use cases